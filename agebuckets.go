@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rbytesByAgeDesc = prometheus.NewDesc(
+	"cephfs_rbytes_by_age",
+	"Total size in bytes of the subdirectories of the monitored path, by time since their ceph.dir.rctime",
+	[]string{"path", "age_bucket"}, nil,
+)
+
+// ageBucket is a range of ages from AGE_BUCKETS, up to (excluding) maxAge,
+// which is 0 for the last one
+type ageBucket struct {
+	label  string
+	maxAge time.Duration
+}
+
+// parseAgeBuckets turns a list of ages such as 30d,90d into the buckets
+// <30d, 30d-90d and >90d
+func parseAgeBuckets(list []string) ([]ageBucket, error) {
+	type bound struct {
+		name string
+		age  time.Duration
+	}
+	bounds := make([]bound, 0, len(list))
+	for _, name := range list {
+		age, err := parseAge(name)
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("Invalid age %q", name)
+		}
+		bounds = append(bounds, bound{name: name, age: age})
+	}
+	if len(bounds) == 0 {
+		return nil, nil
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].age < bounds[j].age })
+
+	buckets := []ageBucket{{label: "<" + bounds[0].name, maxAge: bounds[0].age}}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i].age == bounds[i-1].age {
+			return nil, fmt.Errorf("Duplicate age %q", bounds[i].name)
+		}
+		buckets = append(buckets, ageBucket{
+			label:  bounds[i-1].name + "-" + bounds[i].name,
+			maxAge: bounds[i].age,
+		})
+	}
+	buckets = append(buckets, ageBucket{label: ">" + bounds[len(bounds)-1].name})
+	return buckets, nil
+}
+
+// observeAgeBuckets emits the size of the subdirectories of a monitored path
+// summed by age bucket, which only costs two xattrs per subdirectory and a
+// few series per path
+func (c *Collector) observeAgeBuckets(path string, col *collection) error {
+	dirs, _, err := c.readDirNames(path, col)
+	if err != nil {
+		return err
+	}
+
+	sums := make([]uint64, len(c.ageBuckets))
+	now := time.Now()
+	for _, name := range dirs {
+		subdir := filepath.Join(path, name)
+		rbytes, err := col.getNumXattr(col.filesystem, subdir, "ceph.dir.rbytes")
+		if err != nil && isPermissionDenied(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Getting rbytes of %s: %w", subdir, err)
+		}
+		value, err := getXattr(col.filesystem, subdir, "ceph.dir.rctime")
+		if err != nil {
+			return fmt.Errorf("Getting rctime of %s: %w", subdir, err)
+		}
+		modified, err := parseTimestamp(string(value))
+		if err != nil {
+			return fmt.Errorf("Invalid rctime %q of %s", value, subdir)
+		}
+
+		age := now.Sub(modified)
+		for i, bucket := range c.ageBuckets {
+			if bucket.maxAge == 0 || age < bucket.maxAge {
+				sums[i] += rbytes
+				break
+			}
+		}
+	}
+
+	for i, bucket := range c.ageBuckets {
+		col.emit(prometheus.MustNewConstMetric(
+			rbytesByAgeDesc,
+			prometheus.GaugeValue,
+			float64(sums[i]),
+			c.pathLabel(path),
+			bucket.label,
+		))
+	}
+	return nil
+}
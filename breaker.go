@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// latencyMinWalks is the number of walks in MDS_LATENCY_WINDOW needed to open
+// the circuit, so a single slow walk doesn't
+const latencyMinWalks = 3
+
+// latencySample is the xattr read time of a walk
+type latencySample struct {
+	time     time.Time
+	reads    int
+	readTime time.Duration
+}
+
+// checkLatency opens the circuit if the xattr reads of the walks over the
+// last MDS_LATENCY_WINDOW were slow on average, so we stop loading an
+// overloaded MDS
+func (c *Collector) checkLatency(col *collection) {
+	if c.mdsLatencyThreshold <= 0 || col.xattrReads == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	samples := c.latencySamples[:0]
+	for _, sample := range c.latencySamples {
+		if now.Sub(sample.time) < c.mdsLatencyWindow {
+			samples = append(samples, sample)
+		}
+	}
+	samples = append(samples, latencySample{now, col.xattrReads, col.xattrReadTime})
+	c.latencySamples = samples
+	if len(samples) < latencyMinWalks {
+		return
+	}
+
+	var reads int
+	var readTime time.Duration
+	for _, sample := range samples {
+		reads += sample.reads
+		readTime += sample.readTime
+	}
+	average := readTime / time.Duration(reads)
+	if average > c.mdsLatencyThreshold {
+		log.Printf("MDS latency is high (%v over %d walks), serving cached data for %v", average, len(samples), c.mdsLatencyWindow)
+		c.circuitUntil = now.Add(c.mdsLatencyWindow)
+		c.latencySamples = nil
+	}
+}
+
+// circuitOpen returns whether we should serve cached data instead of walking.
+// Once the window has elapsed, a single read is used to check whether the MDS
+// has recovered
+func (c *Collector) circuitOpen() bool {
+	if c.mdsLatencyThreshold <= 0 {
+		return false
+	}
+
+	c.mutex.Lock()
+	if c.circuitUntil.IsZero() {
+		c.mutex.Unlock()
+		return false
+	}
+	// Keep serving cached data while another scrape checks the MDS
+	if time.Now().Before(c.circuitUntil) || c.circuitProbing {
+		c.mutex.Unlock()
+		return true
+	}
+	c.circuitProbing = true
+	c.mutex.Unlock()
+
+	// Don't hold the lock while the MDS is slow
+	start := time.Now()
+	_, err := getNumXattr(cephClient{c.filesystem}, "/", "ceph.dir.rbytes")
+	latency := time.Since(start)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.circuitProbing = false
+	if err != nil || latency > c.mdsLatencyThreshold {
+		log.Printf("MDS latency is still high (%v), serving cached data for %v", latency, c.mdsLatencyWindow)
+		c.circuitUntil = time.Now().Add(c.mdsLatencyWindow)
+		return true
+	}
+
+	log.Printf("MDS latency recovered (%v), resuming collection", latency)
+	c.circuitUntil = time.Time{}
+	return false
+}
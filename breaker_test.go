@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	c := testCollector(newFakeFS(testTree))
+	c.mdsLatencyThreshold = time.Millisecond
+	c.mdsLatencyWindow = time.Minute
+	slow := &collection{xattrReads: 10, xattrReadTime: 10 * 2 * time.Millisecond}
+	fast := &collection{xattrReads: 10, xattrReadTime: 10 * time.Microsecond}
+
+	// A single slow walk doesn't open the circuit
+	c.checkLatency(fast)
+	c.checkLatency(fast)
+	c.checkLatency(slow)
+	if !c.circuitUntil.IsZero() {
+		t.Fatal("Circuit opened by a single slow walk")
+	}
+
+	// It opens once the average over the window is high
+	c.checkLatency(slow)
+	c.checkLatency(slow)
+	if c.circuitUntil.IsZero() {
+		t.Fatal("Circuit not opened by slow walks")
+	}
+}
+
+func TestCircuitOpenWithoutCache(t *testing.T) {
+	c := testCollector(newFakeFS(testTree))
+	c.mdsLatencyThreshold = time.Millisecond
+	c.mdsLatencyWindow = time.Minute
+	c.circuitUntil = time.Now().Add(time.Minute)
+
+	// Nothing was cached yet, so this walks
+	paths, err := gatherRbytes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, paths, []string{"/", "/a", "/a/x", "/b"})
+
+	// Then serves that walk while the circuit is open
+	c.paths = []string{"/b"}
+	paths, err = gatherRbytes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, paths, []string{"/", "/a", "/a/x", "/b"})
+}
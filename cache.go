@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheEnabled returns whether we need to keep the metrics of the last walk
+func (c *Collector) cacheEnabled() bool {
+	return c.cacheTTL > 0 || c.mdsLatencyThreshold > 0 || c.walkOnce || c.pausable
+}
+
+// serveCache sends the metrics of the last walk, returning their age
+func (c *Collector) serveCache(ch chan<- prometheus.Metric) time.Duration {
+	c.mutex.Lock()
+	cached := c.cachedMetrics
+	cacheTime := c.cacheTime
+	c.mutex.Unlock()
+	for _, metric := range cached {
+		if c.cacheTimestamps {
+			metric = prometheus.NewMetricWithTimestamp(cacheTime, metric)
+		}
+		ch <- metric
+	}
+	return time.Since(cacheTime)
+}
+
+// hasCache returns whether there are metrics of a previous walk to serve
+func (c *Collector) hasCache() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.cacheTime.IsZero()
+}
+
+// useCache returns whether the cached metrics should be served instead of
+// walking. If it returns false, the caller is expected to walk
+func (c *Collector) useCache() bool {
+	if c.cacheTTL <= 0 && !c.walkOnce {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.walkOnce && c.cachedMetrics != nil {
+		return true
+	}
+	if c.cachedMetrics != nil {
+		if time.Since(c.cacheTime) < c.cacheTTL {
+			return true
+		}
+
+		// Expired, but another scrape is already walking, don't start
+		// another walk
+		if c.refreshing {
+			c.staleServed++
+			return true
+		}
+	}
+
+	c.refreshing = true
+	return false
+}
+
+// cancelRefresh undoes useCache marking the cache as being refreshed, for a
+// scrape that ended up not walking
+func (c *Collector) cancelRefresh() {
+	if c.cacheTTL <= 0 && !c.walkOnce {
+		return
+	}
+	c.mutex.Lock()
+	c.refreshing = false
+	c.mutex.Unlock()
+}
+
+// refresh walks in the background to update the cached metrics, unless a
+// walk is already in progress or walking is paused. It waits for a slot if
+// MAX_CONCURRENT_SCRAPES walks are already running
+func (c *Collector) refresh() {
+	if c.isPaused() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.refreshing {
+		return
+	}
+	c.refreshing = true
+	go func() {
+		c.waitScrape()
+		defer c.releaseScrape()
+		c.walk(nil)
+	}()
+}
+
+// serveReload walks again in the background on POST with the right bearer
+// token
+func serveReload(token string, collectors []*Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkToken(w, r, token) {
+			return
+		}
+
+		log.Print("Reload requested, walking again")
+		for _, c := range collectors {
+			c.refresh()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// refreshOnSignal walks again when receiving SIGHUP
+func refreshOnSignal(collectors []*Collector) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Print("Got SIGHUP, walking again")
+		for _, c := range collectors {
+			c.refresh()
+		}
+	}
+}
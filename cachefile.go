@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// The first line of a cache file holds the time of the walk
+const cacheFileHeader = "# cephfs-exporter cache "
+
+// metricsCollector serves a fixed list of metrics, to gather them
+type metricsCollector []prometheus.Metric
+
+func (m metricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (m metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range m {
+		ch <- metric
+	}
+}
+
+// cacheFilePath returns the cache file of a filesystem, there is one per
+// filesystem if several are mounted
+func cacheFilePath(base string, fsName string) string {
+	if fsName == "" {
+		return base
+	}
+	return base + "." + fsName
+}
+
+// saveCacheFile writes the metrics of the last walk to a file, in the text
+// exposition format
+func (c *Collector) saveCacheFile(path string) error {
+	c.mutex.Lock()
+	cached := c.cachedMetrics
+	cacheTime := c.cacheTime
+	c.mutex.Unlock()
+	if cached == nil {
+		return nil
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsCollector(cached))
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename, so we never leave a partial file
+	file, err := os.CreateTemp(filepath.Dir(path), ".cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "%s%d\n", cacheFileHeader, cacheTime.UnixNano())
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(writer, family); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// loadCacheFile reads metrics written by saveCacheFile, to serve them until
+// a walk completes
+func (c *Collector) loadCacheFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, cacheFileHeader) {
+		return fmt.Errorf("Not a cache file")
+	}
+	nanos, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(header, cacheFileHeader)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid cache time: %w", err)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(reader)
+	if err != nil {
+		return err
+	}
+	metrics := []prometheus.Metric{}
+	for _, family := range families {
+		for _, m := range family.Metric {
+			metric, err := constMetric(family, m)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+
+	c.mutex.Lock()
+	c.cachedMetrics = metrics
+	c.cacheTime = time.Unix(0, nanos)
+	c.mutex.Unlock()
+	return nil
+}
+
+// constMetric turns a parsed sample back into a metric. We only emit gauges
+// and counters
+func constMetric(family *dto.MetricFamily, m *dto.Metric) (prometheus.Metric, error) {
+	names := make([]string, 0, len(m.Label))
+	values := make([]string, 0, len(m.Label))
+	for _, label := range m.Label {
+		names = append(names, label.GetName())
+		values = append(values, label.GetValue())
+	}
+	desc := prometheus.NewDesc(family.GetName(), family.GetHelp(), names, nil)
+
+	switch family.GetType() {
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), values...)
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), values...)
+	default:
+		return nil, fmt.Errorf("Unsupported metric type %s for %s", family.GetType(), family.GetName())
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var coldRbytesDesc = prometheus.NewDesc(
+	"cephfs_cold_rbytes",
+	"Total size in bytes of the directories under the monitored path not modified for COLD_DATA_AGE",
+	[]string{"path"}, nil,
+)
+
+// parseAge parses a duration, also accepting a number of days such as "90d"
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ianschenck/envflag"
+)
+
+// loadConfigFile sets the settings from a YAML file, with keys named after
+// the environment variables (either case). Only a flat mapping is supported,
+// values are scalars or lists of scalars, which are joined with commas.
+// Settings from the environment take precedence
+func loadConfigFile(path string) error {
+	values, err := parseConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range values {
+		name := strings.ToUpper(item.key)
+		if envflag.Lookup(name) == nil || name == "CONFIG_FILE" {
+			return fmt.Errorf("%s:%d: Unknown setting %s", path, item.line, item.key)
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if err := envflag.Set(name, item.value); err != nil {
+			return fmt.Errorf("%s:%d: Invalid value for %s: %w", path, item.line, item.key, err)
+		}
+	}
+	return nil
+}
+
+type configValue struct {
+	key   string
+	value string
+	line  int
+}
+
+func parseConfigFile(path string) ([]configValue, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var values []configValue
+	seen := make(map[string]bool)
+	var list *configValue
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := stripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indented := strings.TrimLeft(line, " \t") != line
+
+		// Items of a block list, indented under their key
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if list == nil || !indented {
+				return nil, fmt.Errorf("%s:%d: Unexpected list item", path, lineNo)
+			}
+			item := unquote(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if list.value != "" {
+				list.value += ","
+			}
+			list.value += item
+			continue
+		}
+		if indented {
+			return nil, fmt.Errorf("%s:%d: Nested mappings are not supported", path, lineNo)
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: Expected key: value", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if seen[strings.ToUpper(key)] {
+			return nil, fmt.Errorf("%s:%d: Duplicate setting %s", path, lineNo, key)
+		}
+		seen[strings.ToUpper(key)] = true
+
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			// Inline list
+			var items []string
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, unquote(item))
+				}
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquote(value)
+		}
+		values = append(values, configValue{key: key, value: value, line: lineNo})
+
+		// An empty value might be followed by a block list
+		list = nil
+		if value == "" {
+			list = &values[len(values)-1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripComment removes a comment from a line, unless the # is quoted
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
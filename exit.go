@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes for startup failures, so supervisors can tell them apart
+const (
+	exitConfig   = 2 // invalid settings, or config file can't be read
+	exitConnect  = 3 // can't connect to the cluster
+	exitMount    = 4 // can't mount a filesystem
+	exitSelfTest = 5 // no recursive stats, or self-test failed with SELF_TEST_STRICT
+	exitServe    = 6 // can't serve metrics
+	exitPush     = 7 // can't push metrics with PUSHGATEWAY_URL
+)
+
+var exitPrefixes = map[int]string{
+	exitConfig:   "config",
+	exitConnect:  "connect",
+	exitMount:    "mount",
+	exitSelfTest: "self-test",
+	exitServe:    "serve",
+	exitPush:     "push",
+}
+
+// fatalf logs a message, prefixed with the class of failure, and exits with
+// the matching code
+func fatalf(code int, format string, args ...interface{}) {
+	log.Printf("[%s] %s", exitPrefixes[code], fmt.Sprintf(format, args...))
+	os.Exit(code)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var featureEnabledDesc = prometheus.NewDesc(
+	"cephfs_feature_enabled",
+	"Whether an optional feature is enabled",
+	[]string{"feature"}, nil,
+)
+
+// features lists the optional features and whether they are enabled, for
+// /-/config and cephfs_feature_enabled
+func (c *Collector) features() map[string]bool {
+	return map[string]bool{
+		"leaves_only":         c.leavesOnly,
+		"children_recursed":   c.countChildren,
+		"skip_empty_dirs":     c.skipEmptyDirs,
+		"skip_root_path":      c.skipRootPath,
+		"emit_min_entries":    c.emitMinEntries > 0,
+		"exclude_name":        c.excludeName != nil,
+		"max_entries_per_dir": c.maxEntriesPerDir > 0,
+		"max_series":          c.maxSeries > 0,
+		"owner_filter":        c.filterUID >= 0 || c.filterGID >= 0,
+		"estimated_objects":   c.emitObjects,
+		"recurse_by_rank":     c.recurseByRank,
+		"subtree_concurrency": c.subtreeWorkers > 1,
+		"large_files":         c.trackLargeFiles,
+		"readdir_plus":        c.trackLargeFiles && c.readDirPlus,
+		"rbytes_delta":        c.emitRbytesDelta,
+		"dir_changed":         c.emitDirChanged,
+		"min_change":          c.minChangePercent > 0,
+		"modified_since":      c.modifiedSince > 0,
+		"cold_data":           c.coldDataAge > 0,
+		"local_bytes":         c.emitLocalBytes,
+		"layout":              c.emitLayout,
+		"statx":               c.emitStatx,
+		"quota":               c.emitQuota,
+		"timestamp_xattrs":    len(c.timestampXattrs) > 0,
+		"age_buckets":         len(c.ageBuckets) > 0,
+		"snapshots":           c.snapshotPrefix != "",
+		"snapshot_overhead":   len(c.overheadPaths) > 0,
+		"subvolume_discovery": c.findSubvolumes,
+		"group_totals":        c.groupTotals,
+		"root_glob":           c.rootGlob != nil,
+		"root_total":          c.emitRootTotal,
+		"mark_truncated":      c.markTruncated,
+		"relpath_label":       c.relpathLabel,
+		"path_components":     c.pathComponents,
+		"dir_info":            c.dirInfoDesc != nil,
+		"hash_path_labels":    c.hashPathLabels,
+		"best_effort":         c.bestEffort,
+		"cache":               c.cacheTTL > 0,
+		"path_cache":          len(c.pathTTLs) > 0,
+		"cache_timestamps":    c.cacheTimestamps,
+		"walk_once":           c.walkOnce,
+		"circuit_breaker":     c.mdsLatencyThreshold > 0,
+		"scrape_limit":        c.scrapeSlots != nil,
+		"mount_pool":          c.mounts != nil,
+		"pause":               c.pausable,
+		"pause_endpoint":      c.pauseEndpoint,
+		"reload_endpoint":     c.reloadEndpoint,
+		"quit_endpoint":       c.quitEndpoint,
+		"tls":                 c.serveTLS,
+	}
+}
+
+func (c *Collector) emitFeatures(ch chan<- prometheus.Metric) {
+	for feature, enabled := range c.features() {
+		var value float64
+		if enabled {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			featureEnabledDesc,
+			prometheus.GaugeValue,
+			value,
+			feature,
+		)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	rados "github.com/ceph/go-ceph/rados"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mdsUpDesc = prometheus.NewDesc(
+		"cephfs_mds_up",
+		"Number of MDS daemons holding a rank",
+		nil, nil,
+	)
+	mdsStandbyDesc = prometheus.NewDesc(
+		"cephfs_mds_standby",
+		"Number of standby MDS daemons",
+		nil, nil,
+	)
+	clientCountDesc = prometheus.NewDesc(
+		"cephfs_client_count",
+		"Number of clients connected to the filesystem",
+		[]string{"filesystem"}, nil,
+	)
+)
+
+// fsStatus is the part of the output of "ceph fs status" that we use
+type fsStatus struct {
+	Clients []struct {
+		Clients int    `json:"clients"`
+		FS      string `json:"fs"`
+	} `json:"clients"`
+	MDSMap []struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+	} `json:"mdsmap"`
+}
+
+// FSStatusCollector exports cluster-level CephFS health from the mgr, which
+// requires broader caps than reading the filesystem
+type FSStatusCollector struct {
+	prometheus.Collector
+	conn            *rados.Conn
+	disabledMetrics map[string]bool
+}
+
+func (c *FSStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mdsUpDesc
+	ch <- mdsStandbyDesc
+	ch <- clientCountDesc
+}
+
+func (c *FSStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	status, err := c.getStatus()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	up := 0
+	standby := 0
+	for _, mds := range status.MDSMap {
+		if strings.HasPrefix(mds.State, "standby") {
+			standby++
+		} else {
+			up++
+		}
+	}
+	if metricEnabled(c.disabledMetrics, "cephfs_mds_up") {
+		ch <- prometheus.MustNewConstMetric(
+			mdsUpDesc,
+			prometheus.GaugeValue,
+			float64(up),
+		)
+	}
+	if metricEnabled(c.disabledMetrics, "cephfs_mds_standby") {
+		ch <- prometheus.MustNewConstMetric(
+			mdsStandbyDesc,
+			prometheus.GaugeValue,
+			float64(standby),
+		)
+	}
+
+	if metricEnabled(c.disabledMetrics, "cephfs_client_count") {
+		for _, clients := range status.Clients {
+			ch <- prometheus.MustNewConstMetric(
+				clientCountDesc,
+				prometheus.GaugeValue,
+				float64(clients.Clients),
+				clients.FS,
+			)
+		}
+	}
+}
+
+func (c *FSStatusCollector) getStatus() (*fsStatus, error) {
+	cmd, err := json.Marshal(map[string]string{
+		"prefix": "fs status",
+		"format": "json",
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, info, err := c.conn.MgrCommand([][]byte{cmd})
+	if err != nil {
+		return nil, fmt.Errorf("Getting fs status: %w (%s)", err, info)
+	}
+	var status fsStatus
+	if err := json.Unmarshal(out, &status); err != nil {
+		return nil, fmt.Errorf("Parsing fs status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// parseRootGlob checks a ROOT_GLOB pattern and splits it into its components
+func parseRootGlob(pattern string) ([]string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("Pattern must be absolute")
+	}
+	var components []string
+	for _, component := range strings.Split(path.Clean(pattern), "/") {
+		if component == "" {
+			continue
+		}
+		if _, err := path.Match(component, ""); err != nil {
+			return nil, fmt.Errorf("Invalid component %s: %w", component, err)
+		}
+		components = append(components, component)
+	}
+	if len(components) == 0 {
+		return nil, fmt.Errorf("Pattern matches only /")
+	}
+	return components, nil
+}
+
+// expandRootGlob lists the directories matching the ROOT_GLOB components, one
+// level at a time. Components without wildcards are not listed. It stops
+// after rootGlobMax directories, matched or listed, to bound the cost on a
+// large tree
+func (c *Collector) expandRootGlob(col *collection) ([]string, error) {
+	dirs := []string{"/"}
+	listed := 0
+	for _, component := range c.rootGlob {
+		var next []string
+		for _, dir := range dirs {
+			if !strings.ContainsAny(component, `*?[\`) {
+				next = append(next, path.Join(dir, component))
+				continue
+			}
+			if listed >= c.rootGlobMax {
+				return nil, fmt.Errorf("Listed more than %d directories expanding ROOT_GLOB", c.rootGlobMax)
+			}
+			listed++
+			names, _, err := c.readDirNames(dir, col)
+			if err != nil && isNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if matched, _ := path.Match(component, name); matched {
+					next = append(next, path.Join(dir, name))
+				}
+			}
+		}
+		if len(next) > c.rootGlobMax {
+			return nil, fmt.Errorf("More than %d directories match ROOT_GLOB", c.rootGlobMax)
+		}
+		dirs = next
+	}
+
+	// The last component might not have been listed, only keep directories
+	// that exist (files have no ceph.dir.rbytes)
+	var roots []string
+	for _, dir := range dirs {
+		if _, err := col.getNumXattr(col.filesystem, dir, "ceph.dir.rbytes"); err != nil && (isNotFound(err) || isNoAttribute(err)) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		roots = append(roots, dir)
+	}
+
+	c.mutex.Lock()
+	changed := len(roots) != c.globMatches
+	c.globMatches = len(roots)
+	c.mutex.Unlock()
+	if changed {
+		log.Printf("ROOT_GLOB matched %d directories", len(roots))
+	}
+	return roots, nil
+}
@@ -0,0 +1,183 @@
+//go:build integration
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ceph/go-ceph/cephfs"
+	rados "github.com/ceph/go-ceph/rados"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The integration tests run against a real cluster, configured with the same
+// environment variables as the exporter, e.g. from a ceph/demo container:
+//
+//	CEPH_CONFIG=/etc/ceph/ceph.conf go test -tags integration -run Integration
+
+func getenv(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// mountIntegration connects with the CEPH_* variables and mounts the first
+// filesystem of CEPH_FS_NAMES, or the default one
+func mountIntegration(t *testing.T) *cephfs.MountInfo {
+	t.Helper()
+	conn, err := rados.NewConnWithUser(getenv("CEPH_USER", defaultCephUser))
+	if err != nil {
+		t.Fatalf("Failed to create rados connection: %v", err)
+	}
+	if content := os.Getenv("CEPH_CONFIG_CONTENT"); content != "" {
+		err = readConfigContent(conn, content)
+	} else {
+		err = readConfigFile(conn, getenv("CEPH_CONFIG", defaultCephConfigPath), 0)
+	}
+	if err != nil {
+		t.Fatalf("Failed to read config file: %v", err)
+	}
+	if key := os.Getenv("CEPH_KEY"); key != "" {
+		if err := conn.SetConfigOption("key", key); err != nil {
+			t.Fatal("Failed to set key")
+		}
+	}
+	if err := conn.Connect(); err != nil {
+		t.Fatalf("Failed to connect to the cluster: %v", err)
+	}
+	t.Cleanup(conn.Shutdown)
+
+	var fsName string
+	if names := splitList(os.Getenv("CEPH_FS_NAMES")); len(names) > 0 {
+		fsName = names[0]
+	}
+	filesystem, err := mountFilesystem(conn, fsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unmountFilesystem(filesystem) })
+	return filesystem
+}
+
+// createTree creates the directories and files with the given sizes, and
+// removes them at the end of the test
+func createTree(t *testing.T, filesystem *cephfs.MountInfo, root string, dirs []string, files map[string]int) {
+	t.Helper()
+	var created []string
+	t.Cleanup(func() {
+		for i := len(created) - 1; i >= 0; i-- {
+			path := created[i]
+			if _, ok := files[path]; ok {
+				filesystem.Unlink(filepath.Join(root, path))
+			} else {
+				filesystem.RemoveDir(filepath.Join(root, path))
+			}
+		}
+	})
+	for _, dir := range append([]string{"."}, dirs...) {
+		if err := filesystem.MakeDir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("Creating %s: %v", dir, err)
+		}
+		created = append(created, dir)
+	}
+	for path, size := range files {
+		file, err := filesystem.Open(filepath.Join(root, path), os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatalf("Creating %s: %v", path, err)
+		}
+		created = append(created, path)
+		_, err = file.Write(make([]byte, size))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("Writing %s: %v", path, err)
+		}
+	}
+	if err := filesystem.SyncFs(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gatherValues collects from a Collector, returning the value of a metric
+// for each path
+func gatherValues(c *Collector, name string) (map[string]float64, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return nil, err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "path" {
+					values[label.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func TestIntegrationRecursiveStats(t *testing.T) {
+	filesystem := mountIntegration(t)
+	root := fmt.Sprintf("/cephfs-exporter-test-%d", time.Now().UnixNano())
+	createTree(t, filesystem, root, []string{"a", "a/x", "b"}, map[string]int{
+		"a/file":   3000,
+		"a/x/file": 2000,
+		"b/file":   500,
+	})
+
+	c := testCollector(cephClient{filesystem})
+	c.filesystem = filesystem
+	c.paths = []string{root}
+	c.recurseMinSize = 0
+
+	// rentries counts the files and the directories, including the
+	// directory itself
+	expectedRbytes := map[string]float64{
+		root:          5500,
+		root + "/a":   5000,
+		root + "/a/x": 2000,
+		root + "/b":   500,
+	}
+	expectedRentries := map[string]float64{
+		root:          7,
+		root + "/a":   4,
+		root + "/a/x": 2,
+		root + "/b":   2,
+	}
+
+	// Recursive stats are propagated lazily, wait for them to add up
+	deadline := time.Now().Add(time.Minute)
+	for {
+		rbytes, err := gatherValues(c, "cephfs_rbytes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rentries, err := gatherValues(c, "cephfs_rentries")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(rbytes, expectedRbytes) && reflect.DeepEqual(rentries, expectedRentries) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got rbytes %v and rentries %v, expected %v and %v", rbytes, rentries, expectedRbytes, expectedRentries)
+		}
+		time.Sleep(time.Second)
+	}
+}
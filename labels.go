@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dirDescs returns the descriptions of cephfs_rbytes and cephfs_rentries,
+// with the optional labels that are enabled
+func dirDescs(truncated bool, relpath bool, components bool) (*prometheus.Desc, *prometheus.Desc) {
+	labels := []string{"path"}
+	if relpath {
+		labels = append(labels, "relpath")
+	}
+	if truncated {
+		labels = append(labels, "truncated")
+	}
+	if components {
+		labels = append(labels, "path_components")
+	}
+	rbytes := prometheus.NewDesc(
+		"cephfs_rbytes",
+		"Total size of directory in bytes",
+		labels, nil,
+	)
+	rentries := prometheus.NewDesc(
+		"cephfs_rentries",
+		"Total number of files and subdirectories",
+		labels, nil,
+	)
+	return rbytes, rentries
+}
+
+// newDirInfoDesc returns the description of cephfs_dir_info, with the labels
+// of the directory metadata that is read
+func newDirInfoDesc(relpath bool, truncated bool, components bool, pin bool, pool bool) *prometheus.Desc {
+	labels := []string{"path"}
+	if relpath {
+		labels = append(labels, "relpath")
+	}
+	if truncated {
+		labels = append(labels, "truncated")
+	}
+	if components {
+		labels = append(labels, "path_components")
+	}
+	if pin {
+		labels = append(labels, "pin")
+	}
+	if pool {
+		labels = append(labels, "pool")
+	}
+	return prometheus.NewDesc(
+		"cephfs_dir_info",
+		"Metadata of the directory in labels, always 1",
+		labels, nil,
+	)
+}
+
+// emitDirInfo emits cephfs_dir_info for a directory, with the values of the
+// labels that would otherwise be on cephfs_rbytes and cephfs_rentries
+func (c *walkConfig) emitDirInfo(dir *dirStats, col *collection, pathLabel string, metadata []string) {
+	if !c.metricEnabled("cephfs_dir_info") {
+		return
+	}
+	labels := append([]string{pathLabel}, metadata...)
+	if c.recurseByRank {
+		labels = append(labels, strconv.FormatInt(dir.pin, 10))
+	}
+	if c.emitLayout {
+		labels = append(labels, dir.pool)
+	}
+	col.emit(prometheus.MustNewConstMetric(
+		c.dirInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		labels...,
+	))
+}
+
+// pathComponents returns the number of directories in an absolute path, 0 for
+// the root
+func pathComponents(path string) int {
+	path = filepath.Clean(path)
+	if path == "/" {
+		return 0
+	}
+	return strings.Count(path, "/")
+}
+
+// layoutPool returns the pool from the value of ceph.dir.layout, e.g.
+// "stripe_unit=4194304 stripe_count=1 object_size=4194304 pool=cephfs_data"
+func layoutPool(layout string) string {
+	for _, field := range strings.Fields(layout) {
+		if name, value, ok := strings.Cut(field, "="); ok && name == "pool" {
+			return value
+		}
+	}
+	return ""
+}
+
+// pathLabel returns the value of the path label for a directory, hashing the
+// directory names if configured
+func (c *walkConfig) pathLabel(path string) string {
+	label := c.hashedPath(path)
+
+	// Paths are always clean (no trailing slash, root is "/"), optionally add
+	// the slash to every directory
+	if c.pathLabelStyle == "trailing-slash" && label != "/" {
+		label += "/"
+	}
+	return label
+}
+
+// hashedPath cleans a path and hashes its directory names if configured
+func (c *walkConfig) hashedPath(path string) string {
+	path = filepath.Clean(path)
+	if !c.hashPathLabels || path == "/" {
+		return path
+	}
+
+	// Replace each component below the kept levels with a hash of the path
+	// up to it, so the same path always maps to the same label
+	components := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	label := make([]string, len(components))
+	for i, component := range components {
+		if i < c.hashKeepLevels {
+			label[i] = component
+		} else {
+			prefix := "/" + strings.Join(components[:i+1], "/")
+			sum := sha256.Sum256([]byte(prefix))
+			label[i] = hex.EncodeToString(sum[:6])
+		}
+	}
+	return "/" + strings.Join(label, "/")
+}
+
+// relpathLabelValue returns the value of the relpath label for a directory,
+// its path relative to the monitored path it was reached from (the root of
+// the tenant), so it is "/" for the monitored path itself
+func (c *walkConfig) relpathLabelValue(root string, path string) string {
+	rel, err := filepath.Rel(c.hashedPath(root), c.hashedPath(path))
+	if err != nil || rel == "." {
+		rel = ""
+	}
+	label := "/" + rel
+	if c.pathLabelStyle == "trailing-slash" && label != "/" {
+		label += "/"
+	}
+	return label
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPathLabelStyle(t *testing.T) {
+	for _, test := range []struct {
+		style    string
+		path     string
+		expected string
+	}{
+		{"clean", "/", "/"},
+		{"clean", "/foo", "/foo"},
+		{"clean", "/foo/", "/foo"},
+		{"clean", "/foo//bar/", "/foo/bar"},
+		{"trailing-slash", "/", "/"},
+		{"trailing-slash", "/foo", "/foo/"},
+		{"trailing-slash", "/foo/", "/foo/"},
+		{"trailing-slash", "/foo/bar", "/foo/bar/"},
+	} {
+		cfg := &walkConfig{pathLabelStyle: test.style}
+		if label := cfg.pathLabel(test.path); label != test.expected {
+			t.Errorf("%s %q: got %q, expected %q", test.style, test.path, label, test.expected)
+		}
+	}
+}
+
+func TestPathLabelStyleWalk(t *testing.T) {
+	// The monitored path and the subdirectories from the walk agree
+	cfg := testWalkConfig()
+	cfg.pathLabelStyle = "trailing-slash"
+	metrics := walkMetrics(t, newFakeFS(testTree), "/a", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/a/", "/a/x/"})
+
+	cfg.pathLabelStyle = "clean"
+	metrics = walkMetrics(t, newFakeFS(testTree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/a", "/a/x", "/b"})
+}
@@ -0,0 +1,44 @@
+package main
+
+// acquireScrape takes a slot to walk the filesystem. If all the slots are
+// taken, it returns false so the caller serves the cached metrics if there
+// are any, otherwise it waits for a slot
+func (c *Collector) acquireScrape() bool {
+	if c.scrapeSlots == nil {
+		return true
+	}
+
+	select {
+	case c.scrapeSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	c.mutex.Lock()
+	haveCache := c.cachedMetrics != nil
+	if haveCache {
+		c.scrapesRejected++
+	}
+	c.mutex.Unlock()
+	if haveCache {
+		return false
+	}
+
+	c.scrapeSlots <- struct{}{}
+	return true
+}
+
+// waitScrape takes a slot to walk the filesystem, waiting for one if they
+// are all taken
+func (c *Collector) waitScrape() {
+	if c.scrapeSlots != nil {
+		c.scrapeSlots <- struct{}{}
+	}
+}
+
+// releaseScrape gives back a slot taken by acquireScrape
+func (c *Collector) releaseScrape() {
+	if c.scrapeSlots != nil {
+		<-c.scrapeSlots
+	}
+}
@@ -1,191 +1,2565 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/ceph/go-ceph/cephfs"
 	rados "github.com/ceph/go-ceph/rados"
 	"github.com/ianschenck/envflag"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
 const (
 	defaultCephConfigPath = "/etc/ceph/ceph.conf"
 	defaultCephUser       = "admin"
+
+	// Object size of the default file layout
+	defaultObjectSize = 4 << 20
 )
 
+var xattrReads = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cephfs_xattr_reads_total",
+	Help: "Number of extended attributes read from the MDS",
+})
+
+var dirEntriesRead = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cephfs_dir_entries_read_total",
+	Help: "Number of directory entries listed, the actual listing work of the walks",
+})
+
+// directoryDepth is replaced in main to have a bucket per level up to
+// RECURSE_MAX_LEVELS, this is its default
+var directoryDepth = newDirectoryDepth(5)
+
+func newDirectoryDepth(maxLevels int) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cephfs_directory_depth",
+		Help:    "Level of the directories visited by the walks, 0 being the monitored paths",
+		Buckets: prometheus.LinearBuckets(0, 1, maxLevels+1),
+	})
+}
+
+var metricsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cephfs_metrics_suppressed_total",
+	Help: "Number of metrics not emitted because of DISABLED_METRICS, or of directories not emitted because of a filter, by reason",
+}, []string{"reason"})
+
+var activeMounts = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cephfs_active_mounts",
+	Help: "Number of filesystem mounts currently held, each is an MDS session",
+})
+
+// metricNames lists the metrics emitted by the collector or registered once
+// by main, which can be turned off with DISABLED_METRICS
+var metricNames = []string{
+	"cephfs_rbytes",
+	"cephfs_rentries",
+	"cephfs_file_size_bytes",
+	"cephfs_rbytes_delta",
+	"cephfs_local_bytes",
+	"cephfs_dir_has_explicit_layout",
+	"cephfs_permission_denied_dirs",
+	"cephfs_largest_directory_bytes",
+	"cephfs_seconds_since_last_success",
+	"cephfs_config_recurse_min_size_bytes",
+	"cephfs_config_recurse_max_levels",
+	"cephfs_circuit_open",
+	"cephfs_cache_age_seconds",
+	"cephfs_cache_stale_served_total",
+	"cephfs_last_walk_timestamp_seconds",
+	"cephfs_collection_in_progress",
+	"cephfs_subtree_scrape_duration_seconds",
+	"cephfs_snapshot_rbytes",
+	"cephfs_scrapes_rejected_total",
+	"cephfs_dir_changed",
+	"cephfs_subvolume_info",
+	"cephfs_tree_depth",
+	"cephfs_dir_nlink",
+	"cephfs_quota_exceeded",
+	"cephfs_path_scrape_success",
+	"cephfs_feature_enabled",
+	"cephfs_statfs_total_bytes",
+	"cephfs_statfs_free_bytes",
+	"cephfs_statfs_files",
+	"cephfs_cold_rbytes",
+	"cephfs_children_recursed",
+	"cephfs_coverage_ratio",
+	"cephfs_walks_total",
+	"cephfs_walks_failed_total",
+	"cephfs_dir_listing_truncated",
+	"cephfs_rbytes_by_age",
+	"cephfs_snapshot_overhead_bytes",
+	"cephfs_estimated_objects",
+	"cephfs_paused",
+	"cephfs_dir_pin",
+	"cephfs_max_concurrent_scrapes",
+	"cephfs_root_rbytes",
+	"cephfs_root_rentries",
+	"cephfs_series_limit_hit",
+	"cephfs_path_recursed",
+	"cephfs_dir_info",
+	"cephfs_seconds_since_reconnect",
+	"cephfs_group_rbytes",
+	"cephfs_group_rentries",
+	"cephfs_xattr_reads_total",
+	"cephfs_dir_entries_read_total",
+	"cephfs_directory_depth",
+	"cephfs_active_mounts",
+	"cephfs_metrics_suppressed_total",
+	"cephfs_mon_rtt_seconds",
+	"cephfs_mds_up",
+	"cephfs_mds_standby",
+	"cephfs_client_count",
+	"cephfs_data_pool_info",
+	"cephfs_data_pool_used_bytes",
+}
+
 var (
-	rbytesDesc = prometheus.NewDesc(
-		"cephfs_rbytes",
-		"Total size of directory in bytes",
+	fileSizeDesc = prometheus.NewDesc(
+		"cephfs_file_size_bytes",
+		"Size of large file in bytes",
+		[]string{"path"}, nil,
+	)
+	rbytesDeltaDesc = prometheus.NewDesc(
+		"cephfs_rbytes_delta",
+		"Change in total size of directory in bytes since the previous collection",
+		[]string{"path"}, nil,
+	)
+	quotaExceededDesc = prometheus.NewDesc(
+		"cephfs_quota_exceeded",
+		"Whether the directory is bigger than its ceph.quota.max_bytes",
+		[]string{"path"}, nil,
+	)
+	dirNlinkDesc = prometheus.NewDesc(
+		"cephfs_dir_nlink",
+		"Number of hard links to the directory, normally its number of subdirectories plus 2",
+		[]string{"path"}, nil,
+	)
+	dirChangedDesc = prometheus.NewDesc(
+		"cephfs_dir_changed",
+		"Whether anything in the directory changed since the previous collection, from ceph.dir.rctime",
+		[]string{"path"}, nil,
+	)
+	localBytesDesc = prometheus.NewDesc(
+		"cephfs_local_bytes",
+		"Size of files directly in directory in bytes, excluding subdirectories",
+		[]string{"path"}, nil,
+	)
+	estimatedObjectsDesc = prometheus.NewDesc(
+		"cephfs_estimated_objects",
+		"Estimated number of RADOS objects of the directory, from its size and the object size of its layout",
+		[]string{"path"}, nil,
+	)
+	explicitLayoutDesc = prometheus.NewDesc(
+		"cephfs_dir_has_explicit_layout",
+		"Whether the directory has its own layout (1) or inherits it (0)",
+		[]string{"path"}, nil,
+	)
+	cacheAgeDesc = prometheus.NewDesc(
+		"cephfs_cache_age_seconds",
+		"Age of the served metrics, 0 if they were just collected",
+		nil, nil,
+	)
+	cacheStaleServedDesc = prometheus.NewDesc(
+		"cephfs_cache_stale_served_total",
+		"Number of scrapes served from expired cache because a walk was in progress",
+		nil, nil,
+	)
+	lastWalkTimestampDesc = prometheus.NewDesc(
+		"cephfs_last_walk_timestamp_seconds",
+		"Time at which the served metrics were collected",
+		nil, nil,
+	)
+	listingTruncatedDesc = prometheus.NewDesc(
+		"cephfs_dir_listing_truncated",
+		"Whether the listing of the directory was stopped at MAX_ENTRIES_PER_DIR, so some subdirectories were not looked at",
+		[]string{"path"}, nil,
+	)
+	childrenRecursedDesc = prometheus.NewDesc(
+		"cephfs_children_recursed",
+		"Number of subdirectories big enough to be recursed into",
 		[]string{"path"}, nil,
 	)
-	rentriesDesc = prometheus.NewDesc(
-		"cephfs_rentries",
-		"Total number of files and subdirectories",
+	pathSuccessDesc = prometheus.NewDesc(
+		"cephfs_path_scrape_success",
+		"Whether the monitored path was walked without error",
 		[]string{"path"}, nil,
 	)
+	coverageRatioDesc = prometheus.NewDesc(
+		"cephfs_coverage_ratio",
+		"Fraction of the size of the monitored path that is in the deepest directories walked, rather than only counted in their parents",
+		[]string{"path"}, nil,
+	)
+	treeDepthDesc = prometheus.NewDesc(
+		"cephfs_tree_depth",
+		"Deepest level below the monitored path at which a directory was big enough to recurse into",
+		[]string{"path"}, nil,
+	)
+	subtreeDurationDesc = prometheus.NewDesc(
+		"cephfs_subtree_scrape_duration_seconds",
+		"Time spent walking each top-level directory",
+		[]string{"path"}, nil,
+	)
+	walksDesc = prometheus.NewDesc(
+		"cephfs_walks_total",
+		"Number of walks of the filesystem that completed, rather than serving cached metrics",
+		nil, nil,
+	)
+	walkFailedDesc = prometheus.NewDesc(
+		"cephfs_walk_failed",
+		"Returned as an error when the walk failed without BEST_EFFORT",
+		nil, nil,
+	)
+	walksFailedDesc = prometheus.NewDesc(
+		"cephfs_walks_failed_total",
+		"Number of walks of the filesystem that completed with an error on some path",
+		nil, nil,
+	)
+	scrapesRejectedDesc = prometheus.NewDesc(
+		"cephfs_scrapes_rejected_total",
+		"Number of scrapes served cached metrics because too many walks were running",
+		nil, nil,
+	)
+	inProgressDesc = prometheus.NewDesc(
+		"cephfs_collection_in_progress",
+		"Number of collections currently running, including this one",
+		nil, nil,
+	)
+	maxInProgressDesc = prometheus.NewDesc(
+		"cephfs_max_concurrent_scrapes",
+		"Highest number of collections running at the same time since startup",
+		nil, nil,
+	)
+	circuitOpenDesc = prometheus.NewDesc(
+		"cephfs_circuit_open",
+		"Whether collection is paused because the MDS is slow, serving cached data",
+		nil, nil,
+	)
+	largestDirectoryDesc = prometheus.NewDesc(
+		"cephfs_largest_directory_bytes",
+		"Size of the largest directory reached by the walk whose subdirectories were not broken out",
+		[]string{"path"}, nil,
+	)
+	permissionDeniedDesc = prometheus.NewDesc(
+		"cephfs_permission_denied_dirs",
+		"Number of directories skipped during the walk because access was denied",
+		nil, nil,
+	)
+	pathRecursedDesc = prometheus.NewDesc(
+		"cephfs_path_recursed",
+		"Whether the walk looked at the subdirectories of the monitored path, 0 if it is smaller than RECURSE_MIN_SIZE",
+		[]string{"path"}, nil,
+	)
+	seriesLimitHitDesc = prometheus.NewDesc(
+		"cephfs_series_limit_hit",
+		"Whether the last walk stopped emitting directories because it reached MAX_SERIES",
+		nil, nil,
+	)
+	rootRbytesDesc = prometheus.NewDesc(
+		"cephfs_root_rbytes",
+		"Total number of bytes in the filesystem",
+		nil, nil,
+	)
+	rootRentriesDesc = prometheus.NewDesc(
+		"cephfs_root_rentries",
+		"Total number of entries in the filesystem",
+		nil, nil,
+	)
+	secondsSinceReconnectDesc = prometheus.NewDesc(
+		"cephfs_seconds_since_reconnect",
+		"Time since the filesystem was last mounted",
+		nil, nil,
+	)
+	secondsSinceLastSuccessDesc = prometheus.NewDesc(
+		"cephfs_seconds_since_last_success",
+		"Time since the last collection that completed without error (or since startup)",
+		nil, nil,
+	)
+	configRecurseMinSizeDesc = prometheus.NewDesc(
+		"cephfs_config_recurse_min_size_bytes",
+		"Configured minimum size of directory to recurse",
+		nil, nil,
+	)
+	configRecurseMaxLevelsDesc = prometheus.NewDesc(
+		"cephfs_config_recurse_max_levels",
+		"Configured maximum levels to recurse",
+		nil, nil,
+	)
 )
 
 type Collector struct {
 	prometheus.Collector
-	filesystem       *cephfs.MountInfo
-	recurseMinSize   uint64
-	recurseMaxLevels int
+	walkConfig
+	filesystem      *cephfs.MountInfo
+	mounts          chan fsClient
+	filesystemName  string
+	emitRbytesDelta bool
+	emitDirChanged  bool
+	snapshotPrefix  string
+	overheadPaths   []string
+	ageBuckets      []ageBucket
+	findSubvolumes  bool
+	groupTotals     bool
+	rootGlob        []string
+	rootGlobMax     int
+	emitRootTotal   bool
+	bestEffort      bool
+	serveTLS        bool
+	pausable        bool
+	pauseEndpoint   bool
+	reloadEndpoint  bool
+	quitEndpoint    bool
+
+	cacheTTL            time.Duration
+	walkOnce            bool
+	cacheTimestamps     bool
+	mdsLatencyThreshold time.Duration
+	mdsLatencyWindow    time.Duration
+	pathTTLs            map[string]time.Duration
+
+	// Number of running collections, more than 1 if scrapes overlap, and
+	// the highest it has been
+	inProgress    int32
+	maxInProgress int32
+
+	// Non-zero if walking is paused with /-/pause
+	paused int32
+
+	// Slots for concurrent walks, nil if unlimited
+	scrapeSlots chan struct{}
+
+	mutex           sync.Mutex
+	lastSuccess     time.Time
+	lastMount       time.Time
+	paths           []string
+	topLevelPaths   []string
+	previousRbytes  map[string]uint64
+	emittedRbytes   map[string]uint64
+	previousRctime  map[string]string
+	cachedMetrics   []prometheus.Metric
+	cacheTime       time.Time
+	refreshing      bool
+	staleServed     uint64
+	scrapesRejected uint64
+	walks           uint64
+	walksFailed     uint64
+	globMatches     int
+	circuitUntil    time.Time
+	circuitProbing  bool
+	latencySamples  []latencySample
+	pathCaches      map[string]*pathCache
 }
 
-func (c Collector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(c, ch)
+// collection holds the state of a single walk of the filesystem
+type collection struct {
+	filesystem       fsClient
+	send             func(prometheus.Metric)
+	metrics          []prometheus.Metric
+	emitted          map[string]bool
+	childrenEmitted  map[string]bool
+	xattrs           map[xattrKey]uint64
+	topLevelPaths    []string
+	previousRbytes   map[string]uint64
+	previousEmitted  map[string]uint64
+	emittedRbytes    map[string]uint64
+	rbytes           map[string]uint64
+	previousRctime   map[string]string
+	rctime           map[string]string
+	xattrReads       int
+	xattrReadTime    time.Duration
+	permissionDenied int
+	largest          *dirStats
+	depth            int
+	rootRbytes       uint64
+	leafRbytes       uint64
+	rootRecursed     bool
+	coldBytes        uint64
+	inCold           bool
+	capture          *pathCache
+	root             string
+	subtreeDurations map[string]time.Duration
+	// parent is the collection this one was forked from to walk a subtree
+	// concurrently, nil otherwise
+	parent *collection
+	// pins are the MDS ranks of the directories, with RECURSE_BY_RANK
+	pins map[string]int64
+	// series is the number of directories emitted, shared with the forked
+	// collections, for MAX_SERIES
+	series *int64
 }
 
-func (c Collector) Collect(ch chan<- prometheus.Metric) {
-	err := c.observePath("/", ch, false, 0)
-	if err != nil {
-		log.Print(err)
+// emit sends a metric (if we are serving a scrape), keeping it if we might need to serve it again
+func (col *collection) emit(metric prometheus.Metric) {
+	if col.send != nil {
+		col.send(metric)
+	}
+	if col.metrics != nil {
+		col.metrics = append(col.metrics, metric)
+	}
+	if col.capture != nil {
+		col.capture.metrics = append(col.capture.metrics, metric)
 	}
 }
 
-func getNumXattr(filesystem *cephfs.MountInfo, path string, attr string) (uint64, error) {
-	value, err := filesystem.GetXattr(path, attr)
-	if err != nil {
-		return 0, err
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	// While paused, only serve the last walk
+	if c.isPaused() {
+		c.serveCache(ch)
+		c.emitPaused(ch, true)
+		return
 	}
-	num, err := strconv.ParseUint(string(value), 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("Invalid number")
+
+	inProgress := atomic.AddInt32(&c.inProgress, 1)
+	defer atomic.AddInt32(&c.inProgress, -1)
+	if c.metricEnabled("cephfs_collection_in_progress") {
+		ch <- prometheus.MustNewConstMetric(
+			inProgressDesc,
+			prometheus.GaugeValue,
+			float64(inProgress),
+		)
 	}
-	return num, nil
-}
 
-func (c Collector) observePath(path string, ch chan<- prometheus.Metric, optional bool, level int) error {
-	// Read rbytes
-	rbytes, err := getNumXattr(c.filesystem, path, "ceph.dir.rbytes")
-	if err != nil {
-		return fmt.Errorf("Getting rbytes: %w", err)
+	// Keep the high-water mark, retrying if another scrape raised it
+	maxInProgress := atomic.LoadInt32(&c.maxInProgress)
+	for inProgress > maxInProgress {
+		if atomic.CompareAndSwapInt32(&c.maxInProgress, maxInProgress, inProgress) {
+			maxInProgress = inProgress
+			break
+		}
+		maxInProgress = atomic.LoadInt32(&c.maxInProgress)
+	}
+	if c.metricEnabled("cephfs_max_concurrent_scrapes") {
+		ch <- prometheus.MustNewConstMetric(
+			maxInProgressDesc,
+			prometheus.GaugeValue,
+			float64(maxInProgress),
+		)
 	}
 
-	// If we are recursing and this directory is small, stop
-	if optional && rbytes < c.recurseMinSize || level > c.recurseMaxLevels {
-		return nil
+	circuitOpen := c.circuitOpen()
+	var cacheAge time.Duration
+	var walkErr error
+	// Walk anyway if there is nothing to serve yet
+	serveCache := (circuitOpen && c.hasCache()) || c.useCache()
+	if !serveCache {
+		// Limit the number of concurrent walks, serving the metrics of the
+		// last walk to extra scrapes
+		if c.acquireScrape() {
+			walkErr = c.walk(ch)
+			c.releaseScrape()
+		} else {
+			c.cancelRefresh()
+			serveCache = true
+		}
+	}
+	if serveCache {
+		cacheAge = c.serveCache(ch)
 	}
 
-	// Read entries
-	rentries, err := getNumXattr(c.filesystem, path, "ceph.dir.rentries")
-	if err != nil {
-		return fmt.Errorf("Getting rentries: %w", err)
+	c.mutex.Lock()
+	lastSuccess := c.lastSuccess
+	lastMount := c.lastMount
+	cacheTime := c.cacheTime
+	staleServed := c.staleServed
+	scrapesRejected := c.scrapesRejected
+	walks, walksFailed := c.walks, c.walksFailed
+	c.mutex.Unlock()
+
+	// Always emit, so staleness keeps climbing while collection fails
+	if c.metricEnabled("cephfs_seconds_since_last_success") {
+		ch <- prometheus.MustNewConstMetric(
+			secondsSinceLastSuccessDesc,
+			prometheus.GaugeValue,
+			time.Since(lastSuccess).Seconds(),
+		)
 	}
 
-	// Emit metrics
-	ch <- prometheus.MustNewConstMetric(
-		rbytesDesc,
-		prometheus.GaugeValue,
-		float64(rbytes),
-		path,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		rentriesDesc,
-		prometheus.GaugeValue,
-		float64(rentries),
-		path,
-	)
+	// The mount is never replaced for now, so this is the time since startup
+	if c.metricEnabled("cephfs_seconds_since_reconnect") {
+		ch <- prometheus.MustNewConstMetric(
+			secondsSinceReconnectDesc,
+			prometheus.GaugeValue,
+			time.Since(lastMount).Seconds(),
+		)
+	}
 
-	// Recurse
-	if rbytes >= c.recurseMinSize {
-		dir, err := c.filesystem.OpenDir(path)
-		if err != nil {
-			return fmt.Errorf("Opening directory: %w", err)
+	// Expose configuration, for auditing
+	if c.metricEnabled("cephfs_config_recurse_min_size_bytes") {
+		ch <- prometheus.MustNewConstMetric(
+			configRecurseMinSizeDesc,
+			prometheus.GaugeValue,
+			float64(c.recurseMinSize),
+		)
+	}
+	if c.metricEnabled("cephfs_config_recurse_max_levels") {
+		ch <- prometheus.MustNewConstMetric(
+			configRecurseMaxLevelsDesc,
+			prometheus.GaugeValue,
+			float64(c.recurseMaxLevels),
+		)
+	}
+
+	if c.metricEnabled("cephfs_feature_enabled") {
+		c.emitFeatures(ch)
+	}
+
+	// Always available, even if the walk is cached or truncated
+	c.emitStatfs(ch)
+
+	if c.cacheEnabled() && c.metricEnabled("cephfs_cache_age_seconds") {
+		ch <- prometheus.MustNewConstMetric(
+			cacheAgeDesc,
+			prometheus.GaugeValue,
+			cacheAge.Seconds(),
+		)
+	}
+	if c.cacheEnabled() && !cacheTime.IsZero() && c.metricEnabled("cephfs_last_walk_timestamp_seconds") {
+		ch <- prometheus.MustNewConstMetric(
+			lastWalkTimestampDesc,
+			prometheus.GaugeValue,
+			float64(cacheTime.UnixNano())/1e9,
+		)
+	}
+	if c.cacheTTL > 0 && c.metricEnabled("cephfs_cache_stale_served_total") {
+		ch <- prometheus.MustNewConstMetric(
+			cacheStaleServedDesc,
+			prometheus.CounterValue,
+			float64(staleServed),
+		)
+	}
+
+	if c.metricEnabled("cephfs_walks_total") {
+		ch <- prometheus.MustNewConstMetric(
+			walksDesc,
+			prometheus.CounterValue,
+			float64(walks),
+		)
+	}
+	if c.metricEnabled("cephfs_walks_failed_total") {
+		ch <- prometheus.MustNewConstMetric(
+			walksFailedDesc,
+			prometheus.CounterValue,
+			float64(walksFailed),
+		)
+	}
+
+	if c.scrapeSlots != nil && c.metricEnabled("cephfs_scrapes_rejected_total") {
+		ch <- prometheus.MustNewConstMetric(
+			scrapesRejectedDesc,
+			prometheus.CounterValue,
+			float64(scrapesRejected),
+		)
+	}
+
+	if c.mdsLatencyThreshold > 0 && c.metricEnabled("cephfs_circuit_open") {
+		value := 0.0
+		if circuitOpen {
+			value = 1.0
 		}
-		for {
-			entryDir, err := dir.ReadDir()
-			if err != nil {
-				return fmt.Errorf("Reading directory: %w", err)
+		ch <- prometheus.MustNewConstMetric(
+			circuitOpenDesc,
+			prometheus.GaugeValue,
+			value,
+		)
+	}
+
+	c.emitPaused(ch, false)
+
+	// Unless best-effort, fail the scrape (HTTP 500) rather than serving
+	// partial data
+	if walkErr != nil && !c.bestEffort {
+		ch <- prometheus.NewInvalidMetric(walkFailedDesc, walkErr)
+	}
+}
+
+// walk collects the metrics for all the monitored paths, sending them to ch
+// if not nil. It keeps going if a path fails, returning the last error
+func (c *Collector) walk(ch chan<- prometheus.Metric) error {
+	filesystem := c.getMount()
+	defer c.putMount(filesystem)
+	var send func(prometheus.Metric)
+	if ch != nil {
+		send = func(metric prometheus.Metric) { ch <- metric }
+	}
+	col := newCollection(filesystem, send)
+	if c.cacheEnabled() {
+		col.metrics = []prometheus.Metric{}
+	}
+	c.mutex.Lock()
+	paths := c.paths
+	if c.emitRbytesDelta && !c.metricDisabled("cephfs_rbytes_delta") {
+		col.previousRbytes = c.previousRbytes
+		col.rbytes = make(map[string]uint64)
+	}
+	if c.emitDirChanged && !c.metricDisabled("cephfs_dir_changed") {
+		col.previousRctime = c.previousRctime
+		col.rctime = make(map[string]string)
+	}
+	if c.minChangePercent > 0 {
+		col.previousEmitted = c.emittedRbytes
+		col.emittedRbytes = make(map[string]uint64)
+	}
+	c.mutex.Unlock()
+
+	var err error
+	if c.findSubvolumes {
+		subvolumes, discoverErr := c.discoverSubvolumes(col)
+		if discoverErr != nil {
+			log.Printf("Discovering subvolumes: %v", discoverErr)
+			err = discoverErr
+		}
+		for _, subvolume := range subvolumes {
+			paths = append(paths, subvolume.path)
+			if c.metricEnabled("cephfs_subvolume_info") {
+				col.emit(prometheus.MustNewConstMetric(
+					subvolumeInfoDesc,
+					prometheus.GaugeValue,
+					1,
+					c.pathLabel(subvolume.path),
+					subvolume.group,
+					subvolume.name,
+				))
+			}
+		}
+	}
+	if c.groupTotals {
+		if groupErr := c.observeGroups(col); groupErr != nil {
+			log.Printf("Subvolume groups: %v", groupErr)
+			err = groupErr
+		}
+	}
+	if c.rootGlob != nil {
+		roots, globErr := c.expandRootGlob(col)
+		if globErr != nil {
+			log.Printf("Expanding ROOT_GLOB: %v", globErr)
+			err = globErr
+		}
+		paths = append(paths, roots...)
+	}
+	// Serve the paths with their own TTL from cache first, so overlapping
+	// paths don't emit their directories again
+	var walkPaths []string
+	for _, path := range paths {
+		if !c.replayPath(path, col) {
+			walkPaths = append(walkPaths, path)
+		}
+	}
+
+	for _, path := range walkPaths {
+		c.startCapture(path, col)
+		pathErr := c.walkPath(path, col)
+		if pathErr == nil && c.metricEnabled("cephfs_tree_depth") {
+			col.emit(prometheus.MustNewConstMetric(
+				treeDepthDesc,
+				prometheus.GaugeValue,
+				float64(col.depth),
+				c.pathLabel(path),
+			))
+		}
+		if pathErr == nil && c.metricEnabled("cephfs_path_recursed") {
+			var recursed float64
+			if col.rootRecursed {
+				recursed = 1
+			}
+			col.emit(prometheus.MustNewConstMetric(
+				pathRecursedDesc,
+				prometheus.GaugeValue,
+				recursed,
+				c.pathLabel(path),
+			))
+		}
+		if pathErr == nil && c.metricEnabled("cephfs_coverage_ratio") {
+			ratio := 0.0
+			if col.rootRbytes > 0 {
+				ratio = float64(col.leafRbytes) / float64(col.rootRbytes)
 			}
-			if entryDir == nil {
-				break
+			// Recursive stats are propagated lazily, they might not add up
+			if ratio > 1 {
+				ratio = 1
 			}
-			if entryDir.Name() == "." || entryDir.Name() == ".." {
-				continue
+			col.emit(prometheus.MustNewConstMetric(
+				coverageRatioDesc,
+				prometheus.GaugeValue,
+				ratio,
+				c.pathLabel(path),
+			))
+		}
+		if pathErr == nil && c.coldDataAge > 0 && c.metricEnabled("cephfs_cold_rbytes") {
+			col.emit(prometheus.MustNewConstMetric(
+				coldRbytesDesc,
+				prometheus.GaugeValue,
+				float64(col.coldBytes),
+				c.pathLabel(path),
+			))
+		}
+		if pathErr == nil && c.ageBuckets != nil && c.metricEnabled("cephfs_rbytes_by_age") {
+			pathErr = c.observeAgeBuckets(path, col)
+		}
+		if pathErr == nil && c.snapshotPrefix != "" && c.metricEnabled("cephfs_snapshot_rbytes") {
+			pathErr = c.observeSnapshots(path, col)
+		}
+		// Keep going with the other paths, reporting which ones failed
+		if pathErr != nil {
+			log.Printf("%s: %v", path, pathErr)
+			err = pathErr
+		}
+		if c.metricEnabled("cephfs_path_scrape_success") {
+			var success float64
+			if pathErr == nil {
+				success = 1
 			}
-			if entryDir.DType() == cephfs.DTypeDir {
-				err := c.observePath(
-					filepath.Join(path, entryDir.Name()),
-					ch,
-					true, // optional, only observe if big enough
-					level+1,
-				)
-				if err != nil {
-					return err
+			col.emit(prometheus.MustNewConstMetric(
+				pathSuccessDesc,
+				prometheus.GaugeValue,
+				success,
+				c.pathLabel(path),
+			))
+		}
+		c.endCapture(path, col, pathErr)
+	}
+
+	if c.metricEnabled("cephfs_subtree_scrape_duration_seconds") {
+		for path, duration := range col.subtreeDurations {
+			col.emit(prometheus.MustNewConstMetric(
+				subtreeDurationDesc,
+				prometheus.GaugeValue,
+				duration.Seconds(),
+				c.pathLabel(path),
+			))
+		}
+	}
+	if col.largest != nil && c.metricEnabled("cephfs_largest_directory_bytes") {
+		col.emit(prometheus.MustNewConstMetric(
+			largestDirectoryDesc,
+			prometheus.GaugeValue,
+			float64(col.largest.rbytes),
+			c.pathLabel(col.largest.path),
+		))
+	}
+	if c.metricEnabled("cephfs_permission_denied_dirs") {
+		col.emit(prometheus.MustNewConstMetric(
+			permissionDeniedDesc,
+			prometheus.GaugeValue,
+			float64(col.permissionDenied),
+		))
+	}
+	if len(c.overheadPaths) > 0 && c.metricEnabled("cephfs_snapshot_overhead_bytes") {
+		for _, path := range c.overheadPaths {
+			if overheadErr := c.observeSnapshotOverhead(path, col); overheadErr != nil {
+				log.Printf("%s: %v", path, overheadErr)
+				err = overheadErr
+			}
+		}
+	}
+	if c.maxSeries > 0 {
+		var limitHit float64
+		if *col.series > int64(c.maxSeries) {
+			log.Printf("More than %d directories to emit, stopped at MAX_SERIES; raise RECURSE_MIN_SIZE or lower RECURSE_MAX_LEVELS", c.maxSeries)
+			limitHit = 1
+		}
+		if c.metricEnabled("cephfs_series_limit_hit") {
+			col.emit(prometheus.MustNewConstMetric(
+				seriesLimitHitDesc,
+				prometheus.GaugeValue,
+				limitHit,
+			))
+		}
+	}
+	if c.emitRootTotal {
+		if rootErr := c.observeRootTotal(col); rootErr != nil {
+			log.Printf("/: %v", rootErr)
+			err = rootErr
+		}
+	}
+
+	c.mutex.Lock()
+	c.walks++
+	if err != nil {
+		c.walksFailed++
+	}
+	if err == nil {
+		c.lastSuccess = time.Now()
+		if c.cacheEnabled() {
+			c.cachedMetrics = col.metrics
+			c.cacheTime = c.lastSuccess
+		}
+	}
+	c.refreshing = false
+	c.topLevelPaths = col.topLevelPaths
+	if col.rbytes != nil {
+		if err != nil {
+			// Keep the previous values of the paths we didn't get to
+			mergeMissing(col.rbytes, c.previousRbytes)
+		}
+		c.previousRbytes = col.rbytes
+	}
+	if col.rctime != nil {
+		if err != nil {
+			for path, rctime := range c.previousRctime {
+				if _, ok := col.rctime[path]; !ok {
+					col.rctime[path] = rctime
 				}
 			}
 		}
+		c.previousRctime = col.rctime
+	}
+	if col.emittedRbytes != nil {
+		if err != nil {
+			mergeMissing(col.emittedRbytes, c.emittedRbytes)
+		}
+		c.emittedRbytes = col.emittedRbytes
+	}
+	c.mutex.Unlock()
+
+	c.checkLatency(col)
+	return err
+}
+
+func (c *Collector) getPaths() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.paths
+}
+
+func (c *Collector) setPaths(paths []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paths = paths
+}
+
+// metricEnabled returns whether a metric should be emitted, counting it as
+// suppressed if not. Use metricDisabled to check before reading the data
+func (c *walkConfig) metricEnabled(name string) bool {
+	return metricEnabled(c.disabledMetrics, name)
+}
+
+// metricEnabled is walkConfig.metricEnabled for the collectors that don't
+// walk the filesystem
+func metricEnabled(disabled map[string]bool, name string) bool {
+	if disabled[name] {
+		metricsSuppressed.WithLabelValues("disabled").Inc()
+		return false
 	}
+	return true
+}
+
+// metricDisabled returns whether a metric is in DISABLED_METRICS, without
+// counting it
+func (c *walkConfig) metricDisabled(name string) bool {
+	return c.disabledMetrics[name]
+}
 
+// xattrKey identifies an extended attribute of a directory
+type xattrKey struct {
+	path string
+	attr string
+}
+
+// observeRootTotal emits the recursive stats of the root of the mount, reusing
+// them if the walk already read them
+func (c *Collector) observeRootTotal(col *collection) error {
+	if c.metricEnabled("cephfs_root_rbytes") {
+		rbytes, err := col.getNumXattr(col.filesystem, "/", "ceph.dir.rbytes")
+		if err != nil {
+			return fmt.Errorf("Failed to read rbytes: %w", err)
+		}
+		col.emit(prometheus.MustNewConstMetric(
+			rootRbytesDesc,
+			prometheus.GaugeValue,
+			float64(rbytes),
+		))
+	}
+	if c.metricEnabled("cephfs_root_rentries") {
+		rentries, err := col.getNumXattr(col.filesystem, "/", "ceph.dir.rentries")
+		if err != nil {
+			return fmt.Errorf("Failed to read rentries: %w", err)
+		}
+		col.emit(prometheus.MustNewConstMetric(
+			rootRentriesDesc,
+			prometheus.GaugeValue,
+			float64(rentries),
+		))
+	}
 	return nil
 }
 
-func main() {
-	var (
-		metricsAddr      = envflag.String("TELEMETRY_ADDR", ":9128", "Host:Port for metrics endpoint")
-		metricsPath      = envflag.String("TELEMETRY_PATH", "/metrics", "URL path for metrics endpoint")
-		cephConfig       = envflag.String("CEPH_CONFIG", defaultCephConfigPath, "Path to Ceph config file")
-		cephUser         = envflag.String("CEPH_USER", defaultCephUser, "Ceph user to connect to cluster")
-		recurseMinSize   = envflag.Uint64("RECURSE_MIN_SIZE", 100_000_000_000, "Minimum size of directory to recurse")
-		recurseMaxLevels = envflag.Int("RECURSE_MAX_LEVELS", 5, "Maximum levels to recurse")
-	)
+// getNumXattr reads a numeric extended attribute, reusing the value if it was
+// already read during this collection (unless col.xattrs is nil). CephFS has
+// no call to get several attributes at once, so avoiding repeated reads is
+// all we can do
+func (col *collection) getNumXattr(filesystem fsClient, path string, attr string) (uint64, error) {
+	key := xattrKey{path: path, attr: attr}
+	if value, ok := col.xattrs[key]; ok {
+		return value, nil
+	}
+	start := time.Now()
+	value, err := getNumXattr(filesystem, path, attr)
+	col.xattrReads++
+	col.xattrReadTime += time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if col.xattrs != nil {
+		col.xattrs[key] = value
+	}
+	return value, nil
+}
 
-	envflag.Parse()
-	conn, err := rados.NewConnWithUser(*cephUser)
+// changedSignificantly returns whether a value changed by more than a
+// percentage
+func changedSignificantly(previous uint64, current uint64, percent float64) bool {
+	if previous == 0 {
+		return current != 0
+	}
+	change := math.Abs(float64(current)-float64(previous)) / float64(previous)
+	return change*100 > percent
+}
+
+// mergeMissing copies the values of src for the keys missing from dst
+func mergeMissing(dst map[string]uint64, src map[string]uint64) {
+	for key, value := range src {
+		if _, ok := dst[key]; !ok {
+			dst[key] = value
+		}
+	}
+}
+
+// isPermissionDenied returns whether err is a Ceph EACCES or EPERM error
+func isPermissionDenied(err error) bool {
+	var cephErr interface{ ErrorCode() int }
+	if !errors.As(err, &cephErr) {
+		return false
+	}
+	code := cephErr.ErrorCode()
+	return code == -int(syscall.EACCES) || code == -int(syscall.EPERM)
+}
+
+// isNoAttribute returns whether err is a Ceph ENODATA error, returned when
+// reading an xattr that is not set
+func isNoAttribute(err error) bool {
+	var cephErr interface{ ErrorCode() int }
+	if !errors.As(err, &cephErr) {
+		return false
+	}
+	return cephErr.ErrorCode() == -int(syscall.ENODATA)
+}
+
+// isNotFound returns whether err is a Ceph ENOENT error
+func isNotFound(err error) bool {
+	var cephErr interface{ ErrorCode() int }
+	if !errors.As(err, &cephErr) {
+		return false
+	}
+	return cephErr.ErrorCode() == -int(syscall.ENOENT)
+}
+
+// getXattr reads an extended attribute, counting it in
+// cephfs_xattr_reads_total
+func getXattr(filesystem fsClient, path string, attr string) ([]byte, error) {
+	xattrReads.Inc()
+	return filesystem.GetXattr(path, attr)
+}
+
+func getNumXattr(filesystem fsClient, path string, attr string) (uint64, error) {
+	value, err := getXattr(filesystem, path, attr)
 	if err != nil {
-		log.Fatalf("Failed to create rados connection: %v", err)
+		return 0, err
 	}
-	err = conn.ReadConfigFile(*cephConfig)
+	num, err := strconv.ParseUint(string(value), 10, 64)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %s", err)
+		return 0, fmt.Errorf("Invalid number")
 	}
+	return num, nil
+}
 
-	err = conn.ReadDefaultConfigFile()
-	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+// dirStats holds the information read about a directory during the walk
+type dirStats struct {
+	path       string
+	rbytes     uint64
+	rentries   uint64
+	level      int
+	truncated  bool
+	recursed   bool
+	localBytes uint64
+	// childrenRecursed is the number of subdirectories we recursed into
+	childrenRecursed int
+	// cold is whether the directory was not modified for COLD_DATA_AGE
+	cold bool
+	// quotaMaxBytes is the value of ceph.quota.max_bytes, 0 if not set or
+	// not read
+	quotaMaxBytes uint64
+	// nlink is the link count from statx, if read
+	nlink uint32
+	// rctime is the raw value of ceph.dir.rctime, if read
+	rctime string
+	// explicitLayout is whether ceph.dir.layout is set on the directory
+	// itself rather than inherited from a parent
+	explicitLayout bool
+	// pool is the data pool of the explicit layout, empty if inherited
+	pool string
+	// timestamps are the values of TIMESTAMP_XATTRS that could be read
+	timestamps []timestampValue
+	// owned is whether the directory matches FILTER_UID and FILTER_GID
+	owned bool
+	// objectSize is the object size of the layout of the directory, if read
+	objectSize uint64
+	// pin is the MDS rank the directory is pinned to, with RECURSE_BY_RANK
+	pin int64
+}
+
+// readDir reads the stats of a directory, returning nil if it is skipped by
+// the size or level gate, or because we are not allowed to read it
+func (c *walkConfig) readDir(path string, col *collection, optional bool, level int) (*dirStats, error) {
+	dir, err := c.readDirStats(path, col, optional, level)
+	if err != nil && isPermissionDenied(err) {
+		log.Printf("Permission denied, skipping %s: %v", path, err)
+		col.permissionDenied++
+		return nil, nil
+	}
+	if dir != nil {
+		directoryDepth.Observe(float64(level))
+	}
+	if dir != nil && level > col.depth {
+		col.depth = level
 	}
+	if dir != nil && level == 0 {
+		col.rootRbytes = dir.rbytes
+	}
+	return dir, err
+}
 
-	err = conn.Connect()
+func (c *walkConfig) readDirStats(path string, col *collection, optional bool, level int) (*dirStats, error) {
+	// Read rbytes
+	rbytes, err := col.getNumXattr(col.filesystem, path, "ceph.dir.rbytes")
 	if err != nil {
-		log.Fatalf("Failed to connect to the cluster: %v", err)
+		return nil, fmt.Errorf("Getting rbytes: %w", err)
 	}
-	defer conn.Shutdown()
-	log.Print("Successfully connected to Ceph cluster!")
 
-	filesystem, err := cephfs.CreateFromRados(conn)
+	// If we are recursing and this directory is small, stop
+	if optional && rbytes < c.recurseMinSize || level > c.recurseMaxLevels {
+		return nil, nil
+	}
+
+	// Read entries
+	rentries, err := col.getNumXattr(col.filesystem, path, "ceph.dir.rentries")
 	if err != nil {
-		log.Fatalf("Failed to create cephfs mountinfo: %v", err)
+		return nil, fmt.Errorf("Getting rentries: %w", err)
 	}
 
-	if err := filesystem.Init(); err != nil {
-		log.Fatalf("Failed to init filesystem: %v", err)
+	// Read subdirectories' rbytes, to compute bytes directly in this directory
+	var localBytes uint64
+	if c.emitLocalBytes && !c.metricDisabled("cephfs_local_bytes") {
+		localBytes, err = c.readLocalBytes(path, rbytes, col)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if err := filesystem.SetMountPerms(cephfs.NewUserPerm(0, 0, []int{0})); err != nil {
-		log.Fatalf("Failed to set mount permissions: %v", err)
+	// Check whether the layout is set on this directory, the non-recursive
+	// xattr is only present if it is
+	var explicitLayout bool
+	var pool string
+	if c.emitLayout && (!c.metricDisabled("cephfs_dir_has_explicit_layout") || c.dirInfoDesc != nil) {
+		layout, err := getXattr(col.filesystem, path, "ceph.dir.layout")
+		if err == nil {
+			explicitLayout = true
+			pool = layoutPool(string(layout))
+		} else if !isNoAttribute(err) {
+			return nil, fmt.Errorf("Getting layout: %w", err)
+		}
 	}
 
-	if err := filesystem.Mount(); err != nil {
-		log.Fatalf("Failed to mount filesystem: %v", err)
+	// Read the pin, to walk one MDS rank at a time
+	var pin int64
+	if c.recurseByRank {
+		pin, err = c.readPin(path, col)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer filesystem.Unmount()
-	log.Print("Successfully mounted Ceph filesystem!")
 
-	prometheus.MustRegister(Collector{
-		filesystem:       filesystem,
-		recurseMinSize:   *recurseMinSize,
-		recurseMaxLevels: *recurseMaxLevels,
-	})
-	http.Handle(*metricsPath, promhttp.Handler())
+	// Read the object size, for directories without their own layout it is
+	// inherited and we assume the default
+	var objectSize uint64
+	if c.emitObjects && !c.metricDisabled("cephfs_estimated_objects") {
+		objectSize, err = col.getNumXattr(col.filesystem, path, "ceph.dir.layout.object_size")
+		if err != nil && isNoAttribute(err) {
+			objectSize = defaultObjectSize
+		} else if err != nil {
+			return nil, fmt.Errorf("Getting object size: %w", err)
+		}
+	}
 
-	log.Printf("Starting server on %s\n", *metricsAddr)
-	log.Fatal(http.ListenAndServe(*metricsAddr, nil))
+	// Read the quota
+	var quotaMaxBytes uint64
+	if c.emitQuota && !c.metricDisabled("cephfs_quota_exceeded") {
+		quotaMaxBytes, err = col.getNumXattr(col.filesystem, path, "ceph.quota.max_bytes")
+		if err != nil && isNoAttribute(err) {
+			quotaMaxBytes = 0
+		} else if err != nil {
+			return nil, fmt.Errorf("Getting quota: %w", err)
+		}
+	}
+
+	// Read the link count
+	var nlink uint32
+	if c.emitStatx && !c.metricDisabled("cephfs_dir_nlink") {
+		stat, err := col.filesystem.Statx(path, cephfs.StatxNlink, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Getting link count: %w", err)
+		}
+		nlink = stat.Nlink
+	}
+
+	// Check the owner, if filtering on it. If it can't be read, don't emit
+	// the directory but keep going
+	owned := true
+	if c.filterUID >= 0 || c.filterGID >= 0 {
+		stat, err := col.filesystem.Statx(path, cephfs.StatxUid|cephfs.StatxGid, 0)
+		if err != nil {
+			log.Printf("%s: Can't get owner, not emitting: %v", path, err)
+			owned = false
+		} else {
+			owned = (c.filterUID < 0 || int64(stat.Uid) == c.filterUID) &&
+				(c.filterGID < 0 || int64(stat.Gid) == c.filterGID)
+		}
+	}
+
+	// Read the time of the latest change in this directory
+	var rctime string
+	if col.rctime != nil || c.modifiedSince > 0 || c.coldDataAge > 0 {
+		value, err := getXattr(col.filesystem, path, "ceph.dir.rctime")
+		if err != nil {
+			return nil, fmt.Errorf("Getting rctime: %w", err)
+		}
+		rctime = string(value)
+	}
+
+	timestamps, err := c.readTimestamps(path, rctime, col)
+	if err != nil {
+		return nil, err
+	}
+
+	var cold bool
+	if c.coldDataAge > 0 {
+		modified, err := parseTimestamp(rctime)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rctime %q", rctime)
+		}
+		cold = time.Since(modified) > c.coldDataAge
+	}
+
+	if level == 1 {
+		col.topLevelPaths = append(col.topLevelPaths, path)
+		if col.capture != nil {
+			col.capture.topLevelPaths = append(col.capture.topLevelPaths, path)
+		}
+	}
+
+	return &dirStats{
+		path:           path,
+		rbytes:         rbytes,
+		rentries:       rentries,
+		level:          level,
+		localBytes:     localBytes,
+		explicitLayout: explicitLayout,
+		pool:           pool,
+		rctime:         rctime,
+		nlink:          nlink,
+		quotaMaxBytes:  quotaMaxBytes,
+		timestamps:     timestamps,
+		owned:          owned,
+		objectSize:     objectSize,
+		pin:            pin,
+		cold:           cold,
+		// If subdirectories would be big enough to recurse but we're at the
+		// maximum depth, this directory's metrics stand in for the part of
+		// the tree we don't break out
+		truncated: level >= c.recurseMaxLevels && rbytes >= c.recurseMinSize,
+	}, nil
+}
+
+// readLocalBytes computes the size of the files directly in a directory, by
+// subtracting the rbytes of each subdirectory from its own. It stops at
+// MAX_ENTRIES_PER_DIR like listDir, counting the subdirectories it didn't
+// reach as local
+func (c *walkConfig) readLocalBytes(path string, rbytes uint64, col *collection) (uint64, error) {
+	handle, err := col.filesystem.OpenDir(path)
+	if err != nil {
+		return 0, fmt.Errorf("Opening directory: %w", err)
+	}
+	defer handle.Close()
+
+	var subdirsBytes uint64
+	entries := 0
+	for {
+		entryDir, err := handle.ReadDir()
+		if err != nil {
+			return 0, fmt.Errorf("Reading directory: %w", err)
+		}
+		if entryDir == nil {
+			break
+		}
+		if entryDir.Name() == "." || entryDir.Name() == ".." {
+			continue
+		}
+		entries++
+		if c.maxEntriesPerDir > 0 && entries > c.maxEntriesPerDir {
+			break
+		}
+		if entryDir.DType() == cephfs.DTypeDir {
+			subdirBytes, err := col.getNumXattr(col.filesystem, filepath.Join(path, entryDir.Name()), "ceph.dir.rbytes")
+			if err != nil {
+				return 0, fmt.Errorf("Getting rbytes: %w", err)
+			}
+			subdirsBytes += subdirBytes
+		}
+	}
+
+	// Recursive stats are propagated lazily, they might not add up
+	if subdirsBytes > rbytes {
+		return 0, nil
+	}
+	return rbytes - subdirsBytes, nil
+}
+
+// listDir returns the subdirectories to consider recursing into, and observes
+// the large files along the way
+func (c *walkConfig) listDir(dir *dirStats, col *collection) ([]string, error) {
+	if dir.rbytes < c.recurseMinSize {
+		return nil, nil
+	}
+	if !dir.owned && c.filterPrune {
+		return nil, nil
+	}
+	if dir.level == 0 && c.recurseMaxLevels > 0 {
+		col.rootRecursed = true
+	}
+
+	handle, err := col.filesystem.OpenDir(dir.path)
+	if err != nil && isPermissionDenied(err) {
+		log.Printf("Permission denied, not listing %s: %v", dir.path, err)
+		col.permissionDenied++
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Opening directory: %w", err)
+	}
+	defer handle.Close()
+
+	// ReadDir returns a single entry per call, and go-ceph has no batched
+	// variant (ReadDirPlus is also one entry per call). However libcephfs
+	// fetches whole directory fragments from the MDS and serves ReadDir from
+	// its cache, so this is not a round-trip per entry. ReadDirPlus gets the
+	// size of the files with the entries, instead of a statx per file
+	observeFiles := c.trackLargeFiles && dir.rbytes >= c.largeFileMinSize && !c.metricDisabled("cephfs_file_size_bytes")
+	readDir := handle.ReadDir
+	if observeFiles && c.readDirPlus {
+		readDir = func() (*dirEntry, error) { return handle.ReadDirPlus(cephfs.StatxSize) }
+	}
+	var subdirs []string
+	entries := 0
+	for {
+		entryDir, err := readDir()
+		if err != nil {
+			return nil, fmt.Errorf("Reading directory: %w", err)
+		}
+		if entryDir == nil {
+			break
+		}
+		if entryDir.Name() == "." || entryDir.Name() == ".." {
+			continue
+		}
+		// The directory's own metrics come from xattrs, only stop looking
+		// for subdirectories in huge flat directories
+		entries++
+		if c.maxEntriesPerDir > 0 && entries > c.maxEntriesPerDir {
+			log.Printf("%s: More than %d entries, not listing the rest", dir.path, c.maxEntriesPerDir)
+			if c.metricEnabled("cephfs_dir_listing_truncated") {
+				col.emit(prometheus.MustNewConstMetric(
+					listingTruncatedDesc,
+					prometheus.GaugeValue,
+					1,
+					c.pathLabel(dir.path),
+				))
+			}
+			break
+		}
+		if entryDir.DType() == cephfs.DTypeDir {
+			// Never descend into excluded names
+			if c.excludeName != nil && c.excludeName.MatchString(entryDir.Name()) {
+				continue
+			}
+			subdirs = append(subdirs, filepath.Join(dir.path, entryDir.Name()))
+		} else if observeFiles && entryDir.DType() == cephfs.DTypeReg {
+			err := c.observeFile(filepath.Join(dir.path, entryDir.Name()), entryDir.stat, col)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return subdirs, nil
+}
+
+func (c *walkConfig) emitDir(dir *dirStats, col *collection) {
+	// Monitored paths might overlap, only emit each directory once
+	if col.wasEmitted(dir.path) {
+		return
+	}
+	col.emitted[dir.path] = true
+	if col.capture != nil {
+		col.capture.dirs = append(col.capture.dirs, dir.path)
+	}
+
+	// Skip empty directories, but always emit the monitored paths
+	if c.skipEmptyDirs && dir.rbytes == 0 && dir.level > 0 {
+		metricsSuppressed.WithLabelValues("empty").Inc()
+		return
+	}
+
+	// Skip directories with few entries, they are still walked if they are
+	// big enough
+	if dir.rentries < c.emitMinEntries && dir.level > 0 {
+		metricsSuppressed.WithLabelValues("few_entries").Inc()
+		return
+	}
+
+	// Only emit the subdirectories of the monitored paths if configured,
+	// they are still walked
+	if c.skipRootPath && dir.level == 0 {
+		metricsSuppressed.WithLabelValues("root_path").Inc()
+		return
+	}
+
+	// Only emit the directories of the owner we filter on
+	if !dir.owned {
+		metricsSuppressed.WithLabelValues("owner").Inc()
+		return
+	}
+
+	// Skip directories that were not modified recently, their
+	// subdirectories are still walked
+	if c.modifiedSince > 0 {
+		modified, err := parseTimestamp(dir.rctime)
+		if err != nil {
+			log.Printf("%s: Invalid rctime %q", dir.path, dir.rctime)
+		} else if time.Since(modified) > c.modifiedSince {
+			metricsSuppressed.WithLabelValues("not_modified").Inc()
+			return
+		}
+	}
+
+	// Skip directories that didn't change much since we last emitted them
+	if col.emittedRbytes != nil {
+		previous, ok := col.previousEmitted[dir.path]
+		if ok && !changedSignificantly(previous, dir.rbytes, c.minChangePercent) {
+			col.emittedRbytes[dir.path] = previous
+			metricsSuppressed.WithLabelValues("unchanged").Inc()
+			return
+		}
+		col.emittedRbytes[dir.path] = dir.rbytes
+	}
+
+	// Protect Prometheus from a misconfigured walk emitting too many paths.
+	// With PER_SUBTREE_CONCURRENCY, subtrees race for the remaining series,
+	// so which directories are dropped can change from walk to walk
+	if c.maxSeries > 0 && atomic.AddInt64(col.series, 1) > int64(c.maxSeries) {
+		metricsSuppressed.WithLabelValues("series_limit").Inc()
+		return
+	}
+
+	pathLabel := c.pathLabel(dir.path)
+	var metadata []string
+	if c.relpathLabel {
+		metadata = append(metadata, c.relpathLabelValue(col.root, dir.path))
+	}
+	if c.markTruncated {
+		metadata = append(metadata, strconv.FormatBool(dir.truncated))
+	}
+	if c.pathComponents {
+		metadata = append(metadata, strconv.Itoa(pathComponents(dir.path)))
+	}
+	labels := []string{pathLabel}
+	if c.dirInfoDesc != nil {
+		c.emitDirInfo(dir, col, pathLabel, metadata)
+	} else {
+		labels = append(labels, metadata...)
+	}
+
+	if c.metricEnabled("cephfs_rbytes") {
+		col.emit(prometheus.MustNewConstMetric(
+			c.rbytesDesc,
+			prometheus.GaugeValue,
+			float64(dir.rbytes),
+			labels...,
+		))
+	}
+	if c.metricEnabled("cephfs_rentries") {
+		col.emit(prometheus.MustNewConstMetric(
+			c.rentriesDesc,
+			prometheus.GaugeValue,
+			float64(dir.rentries),
+			labels...,
+		))
+	}
+
+	if c.emitLocalBytes && c.metricEnabled("cephfs_local_bytes") {
+		col.emit(prometheus.MustNewConstMetric(
+			localBytesDesc,
+			prometheus.GaugeValue,
+			float64(dir.localBytes),
+			pathLabel,
+		))
+	}
+
+	if c.emitLayout && c.metricEnabled("cephfs_dir_has_explicit_layout") {
+		var value float64
+		if dir.explicitLayout {
+			value = 1
+		}
+		col.emit(prometheus.MustNewConstMetric(
+			explicitLayoutDesc,
+			prometheus.GaugeValue,
+			value,
+			pathLabel,
+		))
+	}
+
+	if c.recurseByRank && c.metricEnabled("cephfs_dir_pin") {
+		col.emit(prometheus.MustNewConstMetric(
+			dirPinDesc,
+			prometheus.GaugeValue,
+			float64(dir.pin),
+			pathLabel,
+		))
+	}
+
+	// Every file takes at least one object, so this is a lower bound
+	if dir.objectSize > 0 && c.metricEnabled("cephfs_estimated_objects") {
+		col.emit(prometheus.MustNewConstMetric(
+			estimatedObjectsDesc,
+			prometheus.GaugeValue,
+			math.Ceil(float64(dir.rbytes)/float64(dir.objectSize)),
+			pathLabel,
+		))
+	}
+
+	// Quotas are not enforced right away, directories can go over them
+	if dir.quotaMaxBytes > 0 && c.metricEnabled("cephfs_quota_exceeded") {
+		var value float64
+		if dir.rbytes > dir.quotaMaxBytes {
+			value = 1
+		}
+		col.emit(prometheus.MustNewConstMetric(
+			quotaExceededDesc,
+			prometheus.GaugeValue,
+			value,
+			pathLabel,
+		))
+	}
+
+	for _, timestamp := range dir.timestamps {
+		if !c.metricEnabled(timestamp.xattr.metric) {
+			continue
+		}
+		col.emit(prometheus.MustNewConstMetric(
+			timestamp.xattr.desc,
+			prometheus.GaugeValue,
+			timestamp.seconds,
+			pathLabel,
+		))
+	}
+
+	if c.emitStatx && c.metricEnabled("cephfs_dir_nlink") {
+		col.emit(prometheus.MustNewConstMetric(
+			dirNlinkDesc,
+			prometheus.GaugeValue,
+			float64(dir.nlink),
+			pathLabel,
+		))
+	}
+
+	// rctime only moves forward, so any difference means something changed
+	if col.rctime != nil {
+		col.rctime[dir.path] = dir.rctime
+		if previous, ok := col.previousRctime[dir.path]; ok {
+			var value float64
+			if dir.rctime != previous {
+				value = 1
+			}
+			col.emit(prometheus.MustNewConstMetric(
+				dirChangedDesc,
+				prometheus.GaugeValue,
+				value,
+				pathLabel,
+			))
+		}
+	}
+
+	// Emit delta, if we saw the path in the previous collection
+	if col.rbytes != nil {
+		col.rbytes[dir.path] = dir.rbytes
+		if previous, ok := col.previousRbytes[dir.path]; ok {
+			col.emit(prometheus.MustNewConstMetric(
+				rbytesDeltaDesc,
+				prometheus.GaugeValue,
+				float64(dir.rbytes)-float64(previous),
+				pathLabel,
+			))
+		}
+	}
+}
+
+// observePath emits metrics for path and its subdirectories, depth-first,
+// returning whether path was observed (i.e. not skipped by the size or level
+// gate)
+func (c *walkConfig) observePath(path string, col *collection, optional bool, level int) (bool, error) {
+	dir, err := c.readDir(path, col, optional, level)
+	if err != nil || dir == nil {
+		return false, err
+	}
+
+	// Count cold data once, at the highest cold directory, since everything
+	// below it is cold too
+	if dir.cold && !col.inCold {
+		col.coldBytes += dir.rbytes
+		col.inCold = true
+		defer func() { col.inCold = false }()
+	}
+
+	// Emit metrics, unless we only want leaves, in which case we have to
+	// recurse first
+	if !c.leavesOnly {
+		c.emitDir(dir, col)
+	}
+
+	// Recurse
+	subdirs, err := c.listDir(dir, col)
+	if err != nil {
+		return false, err
+	}
+	if c.recurseByRank {
+		if err := c.sortByRank(dir, subdirs, col); err != nil {
+			return false, err
+		}
+	}
+	// Walk the subtrees of a monitored path concurrently if configured
+	if level == 0 && c.subtreeWorkers > 1 {
+		if err := c.observeSubtrees(dir, subdirs, col); err != nil {
+			return false, err
+		}
+	} else {
+		for _, subdir := range subdirs {
+			start := time.Now()
+			observed, err := c.observePath(
+				subdir,
+				col,
+				true, // optional, only observe if big enough
+				level+1,
+			)
+			if err != nil {
+				return false, err
+			}
+			if observed {
+				dir.recursed = true
+				dir.childrenRecursed++
+				// Time each top-level subtree
+				if level == 0 {
+					col.subtreeDurations[subdir] += time.Since(start)
+				}
+			}
+		}
+	}
+
+	c.emitChildren(dir, col)
+	c.finishDir(dir, col)
+
+	return true, nil
+}
+
+// emitChildren emits the number of subdirectories recursed into, once the
+// recursion is done
+func (c *walkConfig) emitChildren(dir *dirStats, col *collection) {
+	if !c.countChildren || !c.metricEnabled("cephfs_children_recursed") || col.childrenWereEmitted(dir.path) {
+		return
+	}
+	col.childrenEmitted[dir.path] = true
+	col.emit(prometheus.MustNewConstMetric(
+		childrenRecursedDesc,
+		prometheus.GaugeValue,
+		float64(dir.childrenRecursed),
+		c.pathLabel(dir.path),
+	))
+}
+
+// finishDir is called once we know whether we recursed into subdirectories of
+// a directory
+func (c *walkConfig) finishDir(dir *dirStats, col *collection) {
+	if dir.recursed {
+		return
+	}
+
+	// Emit metrics for leaves
+	if c.leavesOnly {
+		c.emitDir(dir, col)
+	}
+
+	// Data in the leaves below the monitored path is broken out
+	if dir.level > 0 {
+		col.leafRbytes += dir.rbytes
+	}
+
+	// Parents are always bigger than their subdirectories, so only look at
+	// directories whose subdirectories are not broken out
+	if col.largest == nil || dir.rbytes > col.largest.rbytes {
+		col.largest = dir
+	}
+}
+
+// observePathBFS emits metrics for path and its subdirectories, breadth-first
+func (c *walkConfig) observePathBFS(path string, col *collection) error {
+	type queued struct {
+		path   string
+		level  int
+		parent *dirStats
+		// top is the top-level directory this one is in, which its time is
+		// counted towards
+		top string
+	}
+
+	queue := []queued{{path: path}}
+	var visited []*dirStats
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+		start := time.Now()
+
+		dir, err := c.readDir(
+			item.path,
+			col,
+			item.parent != nil, // optional, only observe if big enough
+			item.level,
+		)
+		if err != nil {
+			return err
+		}
+		if dir == nil {
+			continue
+		}
+		if item.parent != nil {
+			item.parent.recursed = true
+			item.parent.childrenRecursed++
+		}
+
+		// Count cold data once, at the highest cold directory
+		if dir.cold && (item.parent == nil || !item.parent.cold) {
+			col.coldBytes += dir.rbytes
+		}
+
+		// Emit metrics, unless we only want leaves, in which case we have to
+		// wait for the whole walk
+		if !c.leavesOnly {
+			c.emitDir(dir, col)
+		}
+		visited = append(visited, dir)
+
+		subdirs, err := c.listDir(dir, col)
+		if err != nil {
+			return err
+		}
+		top := item.top
+		if item.level == 1 {
+			top = item.path
+		}
+		for _, subdir := range subdirs {
+			queue = append(queue, queued{path: subdir, level: item.level + 1, parent: dir, top: top})
+		}
+		if top != "" {
+			col.subtreeDurations[top] += time.Since(start)
+		}
+	}
+
+	for _, dir := range visited {
+		c.emitChildren(dir, col)
+		c.finishDir(dir, col)
+	}
+
+	return nil
+}
+
+// observeFile emits the size of a file if it is large enough, using its stat
+// from ReadDirPlus if given
+func (c *walkConfig) observeFile(path string, stat *cephfs.CephStatx, col *collection) error {
+	if stat == nil {
+		var err error
+		stat, err = col.filesystem.Statx(path, cephfs.StatxSize, 0)
+		if err != nil && isNotFound(err) {
+			// Deleted since the directory was listed
+			log.Printf("%s: Deleted before getting its size", path)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Getting file size: %w", err)
+		}
+	}
+
+	// Only emit metric for large files, to limit cardinality
+	if stat.Size >= c.largeFileMinSize {
+		col.emit(prometheus.MustNewConstMetric(
+			fileSizeDesc,
+			prometheus.GaugeValue,
+			float64(stat.Size),
+			c.pathLabel(path),
+		))
+	}
+
+	return nil
+}
+
+// configInfo is the active configuration, as shown by the /-/config endpoint
+type configInfo struct {
+	Filesystem       string            `json:"filesystem,omitempty"`
+	RootPath         string            `json:"root_path"`
+	Paths            []string          `json:"paths"`
+	RecurseMinSize   uint64            `json:"recurse_min_size"`
+	RecurseMaxLevels int               `json:"recurse_max_levels"`
+	RecurseStrategy  string            `json:"recurse_strategy"`
+	ExcludeNameRegex string            `json:"exclude_name_regex"`
+	MaxEntriesPerDir int               `json:"max_entries_per_dir"`
+	MaxSeries        int               `json:"max_series"`
+	LeavesOnly       bool              `json:"leaves_only"`
+	SkipEmptyDirs    bool              `json:"skip_empty_dirs"`
+	TrackLargeFiles  bool              `json:"track_large_files"`
+	LargeFileMinSize uint64            `json:"large_file_min_size"`
+	EmitRbytesDelta  bool              `json:"emit_rbytes_delta"`
+	EmitDirChanged   bool              `json:"emit_dir_changed"`
+	MinChangePercent float64           `json:"min_change_percent"`
+	ModifiedSince    string            `json:"modified_since"`
+	EmitLocalBytes   bool              `json:"emit_local_bytes"`
+	EmitLayout       bool              `json:"emit_layout"`
+	EmitStatx        bool              `json:"emit_statx"`
+	EmitQuota        bool              `json:"emit_quota"`
+	SnapshotPrefix   string            `json:"snapshot_prefix"`
+	MarkTruncated    bool              `json:"mark_truncated"`
+	RelpathLabel     bool              `json:"relpath_label"`
+	HashPathLabels   bool              `json:"hash_path_labels"`
+	HashKeepLevels   int               `json:"hash_path_keep_levels"`
+	PathLabelStyle   string            `json:"path_label_style"`
+	BestEffort       bool              `json:"best_effort"`
+	TopLevelPaths    []string          `json:"top_level_paths"`
+	PathCacheTTL     map[string]string `json:"path_cache_ttl"`
+
+	// Optional features, also exported as cephfs_feature_enabled
+	Features map[string]bool `json:"features"`
+}
+
+func (c *Collector) configInfo() configInfo {
+	c.mutex.Lock()
+	paths := c.paths
+	topLevelPaths := c.topLevelPaths
+	c.mutex.Unlock()
+	labels := make([]string, 0, len(topLevelPaths))
+	for _, path := range topLevelPaths {
+		labels = append(labels, c.pathLabel(path))
+	}
+	pathTTLs := make(map[string]string, len(c.pathTTLs))
+	for path, ttl := range c.pathTTLs {
+		pathTTLs[path] = ttl.String()
+	}
+	var excludeName string
+	if c.excludeName != nil {
+		excludeName = c.excludeName.String()
+	}
+
+	return configInfo{
+		Filesystem:       c.filesystemName,
+		RootPath:         "/",
+		Paths:            paths,
+		RecurseMinSize:   c.recurseMinSize,
+		RecurseMaxLevels: c.recurseMaxLevels,
+		RecurseStrategy:  c.recurseStrategy,
+		ExcludeNameRegex: excludeName,
+		MaxEntriesPerDir: c.maxEntriesPerDir,
+		MaxSeries:        c.maxSeries,
+		LeavesOnly:       c.leavesOnly,
+		SkipEmptyDirs:    c.skipEmptyDirs,
+		TrackLargeFiles:  c.trackLargeFiles,
+		LargeFileMinSize: c.largeFileMinSize,
+		EmitRbytesDelta:  c.emitRbytesDelta,
+		EmitDirChanged:   c.emitDirChanged,
+		MinChangePercent: c.minChangePercent,
+		ModifiedSince:    c.modifiedSince.String(),
+		EmitLocalBytes:   c.emitLocalBytes,
+		EmitLayout:       c.emitLayout,
+		EmitStatx:        c.emitStatx,
+		EmitQuota:        c.emitQuota,
+		SnapshotPrefix:   c.snapshotPrefix,
+		MarkTruncated:    c.markTruncated,
+		RelpathLabel:     c.relpathLabel,
+		HashPathLabels:   c.hashPathLabels,
+		HashKeepLevels:   c.hashKeepLevels,
+		PathLabelStyle:   c.pathLabelStyle,
+		BestEffort:       c.bestEffort,
+		TopLevelPaths:    labels,
+		PathCacheTTL:     pathTTLs,
+		Features:         c.features(),
+	}
+}
+
+func serveConfig(collectors []*Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		infos := make([]configInfo, 0, len(collectors))
+		for _, c := range collectors {
+			infos = append(infos, c.configInfo())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+// splitList splits a comma-separated list, ignoring empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseLabels parses a comma-separated list of name=value
+func parseLabels(list string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, item := range splitList(list) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid label %s", item)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// readConfigFile reads the Ceph config file, retrying for up to wait in case
+// it has not been mounted yet
+func readConfigFile(conn *rados.Conn, path string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		err := conn.ReadConfigFile(path)
+		if err == nil {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		log.Printf("Config file not readable yet, retrying: %v", err)
+		if remaining > 500*time.Millisecond {
+			remaining = 500 * time.Millisecond
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// mountFilesystem mounts a CephFS filesystem from an existing connection; an
+// empty name mounts the default filesystem
+func mountFilesystem(conn *rados.Conn, name string) (*cephfs.MountInfo, error) {
+	filesystem, err := cephfs.CreateFromRados(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create cephfs mountinfo: %w", err)
+	}
+
+	// Free the mountinfo on failure, mounting might be retried
+	fail := func(format string, args ...interface{}) (*cephfs.MountInfo, error) {
+		if err := filesystem.Release(); err != nil {
+			log.Printf("Failed to release cephfs mountinfo: %v", err)
+		}
+		return nil, fmt.Errorf(format, args...)
+	}
+
+	if err := filesystem.Init(); err != nil {
+		return fail("Failed to init filesystem: %w", err)
+	}
+
+	if name != "" {
+		if err := filesystem.SelectFilesystem(name); err != nil {
+			return fail("Failed to select filesystem %s: %w", name, err)
+		}
+	}
+
+	if err := filesystem.SetMountPerms(cephfs.NewUserPerm(0, 0, []int{0})); err != nil {
+		return fail("Failed to set mount permissions: %w", err)
+	}
+
+	if err := filesystem.Mount(); err != nil {
+		return fail("Failed to mount filesystem: %w", err)
+	}
+	activeMounts.Inc()
+
+	return filesystem, nil
+}
+
+// unmountFilesystem unmounts a filesystem mounted by mountFilesystem
+func unmountFilesystem(filesystem *cephfs.MountInfo) {
+	if err := filesystem.Unmount(); err != nil {
+		log.Printf("Failed to unmount filesystem: %v", err)
+		return
+	}
+	activeMounts.Dec()
+}
+
+// readConfigContent reads the Ceph config from a string, through a temporary
+// file that is removed right away
+func readConfigContent(conn *rados.Conn, content string) error {
+	file, err := os.CreateTemp("", "ceph-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return conn.ReadConfigFile(file.Name())
+}
+
+func main() {
+	var (
+		configFile        = envflag.String("CONFIG_FILE", "", "YAML file to read settings from, environment variables take precedence")
+		metricsAddr       = envflag.String("TELEMETRY_ADDR", ":9128", "Host:Port for metrics endpoint")
+		metricsNetwork    = envflag.String("TELEMETRY_NETWORK", "tcp", "Address family to listen on, tcp, tcp4 or tcp6")
+		metricsPath       = envflag.String("TELEMETRY_PATH", "/metrics", "URL path for metrics endpoint")
+		compression       = envflag.String("TELEMETRY_COMPRESSION", "gzip,zstd", "Comma-separated list of encodings offered for metrics responses, empty to disable")
+		emitFSIDLabel     = envflag.Bool("EMIT_FSID_LABEL", false, "Add the cluster fsid as an fsid label to every metric")
+		pushgatewayURL    = envflag.String("PUSHGATEWAY_URL", "", "Collect once and push to this Pushgateway instead of serving metrics")
+		pushgatewayJob    = envflag.String("PUSHGATEWAY_JOB", "cephfs_exporter", "Job name to push metrics as")
+		pushgatewayLabels = envflag.String("PUSHGATEWAY_LABELS", "", "Comma-separated list of name=value grouping labels to push metrics with")
+		remoteWriteURL    = envflag.String("REMOTE_WRITE_URL", "", "Prometheus remote write endpoint to also send metrics to")
+		remoteWriteEvery  = envflag.Duration("REMOTE_WRITE_INTERVAL", time.Minute, "How often to send metrics with remote write")
+		collectJitter     = envflag.Duration("COLLECT_JITTER", 0, "Delay each remote write collection by a random duration up to this, to spread the load of replicas")
+		remoteWriteLabels = envflag.String("REMOTE_WRITE_LABELS", "", "Comma-separated list of name=value labels to add to metrics sent with remote write")
+		remoteWriteUser   = envflag.String("REMOTE_WRITE_USERNAME", "", "Username for basic authentication to the remote write endpoint")
+		remoteWritePass   = envflag.String("REMOTE_WRITE_PASSWORD", "", "Password for basic authentication to the remote write endpoint")
+		logRequestsFlag   = envflag.Bool("LOG_REQUESTS", false, "Log each HTTP request")
+		quitToken         = envflag.String("QUIT_TOKEN", "", "Enable POST /-/quit to shut down, with this bearer token")
+		reloadToken       = envflag.String("RELOAD_TOKEN", "", "Enable POST /-/reload to walk again with WALK_ONCE, with this bearer token")
+		pauseToken        = envflag.String("PAUSE_TOKEN", "", "Enable POST /-/pause and /-/resume to stop and restart walking, with this bearer token")
+		startPaused       = envflag.Bool("PAUSED", false, "Start with walking paused, until POST /-/resume")
+		tlsCertFile       = envflag.String("TLS_CERT_FILE", "", "Serve HTTPS with this certificate, reloaded when it changes")
+		tlsKeyFile        = envflag.String("TLS_KEY_FILE", "", "Private key for TLS_CERT_FILE")
+		readTimeout       = envflag.Duration("HTTP_READ_TIMEOUT", 10*time.Second, "Maximum duration for reading requests")
+		writeTimeout      = envflag.Duration("HTTP_WRITE_TIMEOUT", 5*time.Minute, "Maximum duration for writing responses, including collection (0 to disable)")
+		idleTimeout       = envflag.Duration("HTTP_IDLE_TIMEOUT", time.Minute, "Maximum duration to keep idle connections open")
+		cephConfig        = envflag.String("CEPH_CONFIG", defaultCephConfigPath, "Path to Ceph config file")
+		cephConfigContent = envflag.String("CEPH_CONFIG_CONTENT", "", "Content of the Ceph config file, overrides CEPH_CONFIG")
+		cephUser          = envflag.String("CEPH_USER", defaultCephUser, "Ceph user to connect to cluster")
+		cephKey           = envflag.String("CEPH_KEY", "", "Key of CEPH_USER, overrides the keyring")
+		connectRetries    = envflag.Int("CONNECT_RETRIES", 0, "How many times to retry connecting to the cluster and mounting at startup")
+		retryInterval     = envflag.Duration("CONNECT_RETRY_INTERVAL", 5*time.Second, "How long to wait before retrying to connect, doubled after each attempt")
+		cephClientAddr    = envflag.String("CEPH_CLIENT_ADDR", "", "IP address to connect to the cluster from")
+		clientIDTag       = envflag.String("CLIENT_ID_TAG", "", "Value of the cephfs_exporter entry in the client metadata of the MDS sessions")
+		cephFSNames       = envflag.String("CEPH_FS_NAMES", "", "Comma-separated list of filesystems to mount (default filesystem if empty)")
+		configWait        = envflag.Duration("CONFIG_WAIT", 10*time.Second, "How long to wait for the Ceph config file to become readable")
+		recurseMinSize    = envflag.Uint64("RECURSE_MIN_SIZE", 100_000_000_000, "Minimum size of directory to recurse")
+		recurseMaxLevels  = envflag.Int("RECURSE_MAX_LEVELS", 5, "Maximum levels to recurse")
+		recurseStrategy   = envflag.String("RECURSE_STRATEGY", "dfs", "Order in which to walk directories, dfs or bfs")
+		recurseByRank     = envflag.Bool("RECURSE_BY_RANK", false, "Walk the subdirectories pinned to the same MDS rank together, and emit the pin of each directory")
+		subtreeWorkers    = envflag.Int("PER_SUBTREE_CONCURRENCY", 1, "Number of subdirectories of each monitored path to walk concurrently, the monitored paths are still walked one at a time")
+		leavesOnly        = envflag.Bool("LEAVES_ONLY", false, "Only emit metrics for directories with no recursed subdirectories")
+		countChildren     = envflag.Bool("EMIT_CHILDREN_RECURSED", false, "Emit the number of subdirectories recursed into for each directory")
+		excludeNameRegex  = envflag.String("EXCLUDE_NAME_REGEX", "", "Regular expression matching the names of directories not to recurse into")
+		maxSeries         = envflag.Int("MAX_SERIES", 0, "Stop emitting directories after this many in a walk, to protect Prometheus (0 for unlimited)")
+		maxEntriesPerDir  = envflag.Int("MAX_ENTRIES_PER_DIR", 0, "Stop listing a directory after this many entries, looking for subdirectories (0 for unlimited)")
+		filterUID         = envflag.Int64("FILTER_UID", -1, "Only emit directories owned by this uid (-1 for any)")
+		filterGID         = envflag.Int64("FILTER_GID", -1, "Only emit directories owned by this gid (-1 for any)")
+		filterPrune       = envflag.Bool("FILTER_OWNER_PRUNE", false, "Don't recurse into directories not matching FILTER_UID and FILTER_GID either")
+		emitMinEntries    = envflag.Uint64("EMIT_MIN_ENTRIES", 0, "Don't emit directories with fewer entries than this, they are still walked")
+		skipRootPath      = envflag.Bool("SKIP_ROOT_PATH_METRIC", false, "Don't emit the metrics of the monitored paths themselves, only of their subdirectories")
+		skipEmptyDirs     = envflag.Bool("SKIP_EMPTY_DIRS", false, "Don't emit metrics for directories with no data, except the monitored paths")
+		trackLargeFiles   = envflag.Bool("TRACK_LARGE_FILES", false, "Emit metrics for large files in recursed directories")
+		largeFileMinSize  = envflag.Uint64("LARGE_FILE_MIN_SIZE", 100_000_000_000, "Minimum size of file to emit metrics for")
+		readDirPlus       = envflag.Bool("READDIR_PLUS", false, "Get the file sizes for TRACK_LARGE_FILES while listing directories, instead of a statx call per file")
+		emitRbytesDelta   = envflag.Bool("EMIT_RBYTES_DELTA", false, "Emit the change in size of each directory since the previous collection")
+		emitDirChanged    = envflag.Bool("EMIT_DIR_CHANGED", false, "Emit whether each directory changed since the previous collection, from its rctime")
+		minChangePercent  = envflag.Float64("MIN_CHANGE_PERCENT", 0, "Only emit directories whose size changed by more than this percentage since they were last emitted")
+		modifiedSince     = envflag.Duration("MODIFIED_SINCE", 0, "Only emit directories modified within this duration, from their rctime (0 to disable)")
+		coldDataAgeStr    = envflag.String("COLD_DATA_AGE", "", "Emit the size of directories not modified for this long, e.g. 90d")
+		ageBucketsList    = envflag.String("AGE_BUCKETS", "", "Emit the size of the subdirectories of each monitored path by age, with these bucket boundaries, e.g. 30d,90d")
+		enableFSStatus    = envflag.Bool("ENABLE_FS_STATUS", false, "Export MDS and client counts from the mgr (requires mgr caps)")
+		enablePools       = envflag.Bool("ENABLE_POOL_METRICS", false, "Export the data pools of each filesystem and their usage from the monitors (requires mon caps)")
+		monRTTInterval    = envflag.Duration("MON_RTT_INTERVAL", 0, "Measure the round-trip to the monitors this often, as cephfs_mon_rtt_seconds (0 to disable)")
+		pathsFile         = envflag.String("PATHS_FILE", "", "File listing the paths to monitor, one per line (default: /)")
+		findSubvolumes    = envflag.Bool("SUBVOLUME_DISCOVERY", false, "Monitor each subvolume under /volumes, e.g. CSI volumes")
+		groupTotals       = envflag.Bool("EMIT_GROUP_TOTALS", false, "Emit the total size of each subvolume group under /volumes")
+		rootGlobPattern   = envflag.String("ROOT_GLOB", "", "Monitor the directories matching this pattern, expanded on every collection, e.g. /volumes/*")
+		rootGlobMax       = envflag.Int("ROOT_GLOB_MAX", 1000, "Maximum number of directories to list or match when expanding ROOT_GLOB")
+		pathsInterval     = envflag.Duration("PATHS_FILE_INTERVAL", time.Minute, "How often to re-read PATHS_FILE")
+		walkOnce          = envflag.Bool("WALK_ONCE", false, "Walk once at startup and serve those metrics until /-/reload or SIGHUP")
+		maxScrapes        = envflag.Int("MAX_CONCURRENT_SCRAPES", 1, "Maximum number of walks running at the same time, extra scrapes are served cached metrics or wait (0 for unlimited)")
+		mountPoolSize     = envflag.Int("MOUNT_POOL_SIZE", 1, "Number of mounts of each filesystem, for concurrent walks")
+		cacheTTL          = envflag.Duration("CACHE_TTL", 0, "How long to serve the metrics of a walk before walking again (0 to disable)")
+		pathCacheTTL      = envflag.String("PATH_CACHE_TTL", "", "Comma-separated list of path=duration, to serve the metrics of those paths from cache for that long")
+		cacheTimestamps   = envflag.Bool("CACHE_TIMESTAMPS", false, "Timestamp the metrics served from cache with the time of their walk")
+		cacheFile         = envflag.String("CACHE_FILE", "", "File to save the cached metrics to on shutdown, and load them from on startup")
+		latencyThreshold  = envflag.Duration("MDS_LATENCY_THRESHOLD", 0, "Average xattr read latency over MDS_LATENCY_WINDOW above which to stop walking and serve cached data (0 to disable)")
+		latencyWindow     = envflag.Duration("MDS_LATENCY_WINDOW", time.Minute, "Window to average the latency over, and how long to serve cached data before checking MDS latency again")
+		selfTestStrict    = envflag.Bool("SELF_TEST_STRICT", false, "Exit if an xattr can't be read on the root directory at startup, instead of logging a warning")
+		bestEffort        = envflag.Bool("BEST_EFFORT", true, "Serve partial metrics if the walk fails on some paths, instead of failing the scrape")
+		disabledMetrics   = envflag.String("DISABLED_METRICS", "", "Comma-separated list of metrics not to emit")
+		emitLayout        = envflag.Bool("EMIT_LAYOUT", false, "Emit whether each directory has its own layout or inherits it")
+		emitObjects       = envflag.Bool("EMIT_ESTIMATED_OBJECTS", false, "Emit the estimated number of RADOS objects of each directory, from ceph.dir.layout.object_size")
+		snapshotPrefix    = envflag.String("SNAPSHOT_PREFIX", "", "Emit the size of monitored paths in their snapshots whose name starts with this prefix")
+		emitRootTotal     = envflag.Bool("EMIT_ROOT_TOTAL", false, "Emit the size of the whole filesystem, whatever paths are monitored")
+		overheadPathList  = envflag.String("SNAPSHOT_OVERHEAD_PATHS", "", "Comma-separated list of directories to emit the total size of the snapshots of")
+		emitStatx         = envflag.Bool("EMIT_STATX", false, "Emit the link count of each directory (requires a statx call per directory)")
+		emitQuota         = envflag.Bool("EMIT_QUOTA", false, "Emit whether each directory with a quota is over it")
+		timestampList     = envflag.String("TIMESTAMP_XATTRS", "", "Comma-separated list of xattrs holding a timestamp, to emit as _seconds gauges for each directory, e.g. ceph.dir.rctime")
+		emitLocalBytes    = envflag.Bool("EMIT_LOCAL_BYTES", false, "Emit the size of files directly in each directory (requires reading each subdirectory)")
+		hashPathLabels    = envflag.Bool("HASH_PATH_LABELS", false, "Replace directory names in path labels with hashes")
+		hashKeepLevels    = envflag.Int("HASH_PATH_KEEP_LEVELS", 0, "Number of top-level path components not to hash")
+		pathLabelStyle    = envflag.String("PATH_LABEL_STYLE", "clean", "How to write path labels, clean (no trailing slash) or trailing-slash")
+		markTruncated     = envflag.Bool("MARK_TRUNCATED", false, "Add a truncated label to directories at the maximum level with subdirectories not broken out")
+		emitDirInfo       = envflag.Bool("EMIT_DIR_INFO", false, "Move the labels other than path from cephfs_rbytes and cephfs_rentries to cephfs_dir_info, with the pin and pool")
+		componentsLabel   = envflag.Bool("EMIT_PATH_COMPONENTS_LABEL", false, "Add a path_components label to cephfs_rbytes and cephfs_rentries, the number of directories in the path")
+		relpathLabel      = envflag.Bool("EMIT_RELPATH_LABEL", false, "Add a relpath label to directories with their path relative to the monitored path")
+	)
+
+	envflag.Parse()
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			fatalf(exitConfig, "Failed to load CONFIG_FILE: %v", err)
+		}
+	}
+
+	timestampXattrs, err := parseTimestampXattrs(splitList(*timestampList))
+	if err != nil {
+		fatalf(exitConfig, "Invalid TIMESTAMP_XATTRS: %v", err)
+	}
+
+	// Check the metrics to disable, including those of TIMESTAMP_XATTRS
+	known := append([]string{}, metricNames...)
+	for _, xattr := range timestampXattrs {
+		known = append(known, xattr.metric)
+	}
+	disabled := make(map[string]bool)
+	for _, name := range splitList(*disabledMetrics) {
+		disabled[name] = true
+	}
+	var enabled []string
+	for _, name := range known {
+		if !disabled[name] {
+			enabled = append(enabled, name)
+		}
+	}
+	if len(enabled)+len(disabled) != len(known) {
+		fatalf(exitConfig, "Unknown metric in DISABLED_METRICS, known metrics: %s", strings.Join(known, ", "))
+	}
+	log.Printf("Enabled metrics: %s", strings.Join(enabled, ", "))
+
+	if *recurseStrategy != "dfs" && *recurseStrategy != "bfs" {
+		fatalf(exitConfig, "Invalid RECURSE_STRATEGY: %s", *recurseStrategy)
+	}
+	if *pathLabelStyle != "clean" && *pathLabelStyle != "trailing-slash" {
+		fatalf(exitConfig, "Invalid PATH_LABEL_STYLE: %s", *pathLabelStyle)
+	}
+	pathTTLs, err := parsePathTTLs(*pathCacheTTL)
+	if err != nil {
+		fatalf(exitConfig, "Invalid PATH_CACHE_TTL: %v", err)
+	}
+	if *cacheFile != "" && *cacheTTL <= 0 && !*walkOnce {
+		fatalf(exitConfig, "CACHE_FILE requires CACHE_TTL or WALK_ONCE")
+	}
+	var excludeName *regexp.Regexp
+	if *excludeNameRegex != "" {
+		excludeName, err = regexp.Compile(*excludeNameRegex)
+		if err != nil {
+			fatalf(exitConfig, "Invalid EXCLUDE_NAME_REGEX: %v", err)
+		}
+	}
+	if *subtreeWorkers < 1 {
+		fatalf(exitConfig, "Invalid PER_SUBTREE_CONCURRENCY: %d", *subtreeWorkers)
+	}
+	if *subtreeWorkers > 1 && *recurseStrategy == "bfs" {
+		log.Print("PER_SUBTREE_CONCURRENCY is ignored with RECURSE_STRATEGY=bfs, walking serially")
+	}
+	var overheadPaths []string
+	for _, path := range splitList(*overheadPathList) {
+		if !filepath.IsAbs(path) {
+			fatalf(exitConfig, "Invalid path in SNAPSHOT_OVERHEAD_PATHS: %s", path)
+		}
+		overheadPaths = append(overheadPaths, filepath.Clean(path))
+	}
+	if *collectJitter < 0 {
+		fatalf(exitConfig, "Invalid COLLECT_JITTER: %v", *collectJitter)
+	}
+	ageBuckets, err := parseAgeBuckets(splitList(*ageBucketsList))
+	if err != nil {
+		fatalf(exitConfig, "Invalid AGE_BUCKETS: %v", err)
+	}
+	var coldDataAge time.Duration
+	if *coldDataAgeStr != "" {
+		coldDataAge, err = parseAge(*coldDataAgeStr)
+		if err != nil || coldDataAge <= 0 {
+			fatalf(exitConfig, "Invalid COLD_DATA_AGE: %s", *coldDataAgeStr)
+		}
+	}
+
+	var rootGlob []string
+	if *rootGlobPattern != "" {
+		rootGlob, err = parseRootGlob(*rootGlobPattern)
+		if err != nil {
+			fatalf(exitConfig, "Invalid ROOT_GLOB: %v", err)
+		}
+		if *rootGlobMax < 1 {
+			fatalf(exitConfig, "Invalid ROOT_GLOB_MAX: %d", *rootGlobMax)
+		}
+	}
+
+	if *connectRetries < 0 {
+		fatalf(exitConfig, "Invalid CONNECT_RETRIES: %d", *connectRetries)
+	}
+	if *retryInterval <= 0 {
+		fatalf(exitConfig, "Invalid CONNECT_RETRY_INTERVAL: %v", *retryInterval)
+	}
+
+	// Only monitor the discovered subvolumes and directories, unless given
+	// paths
+	paths := []string{"/"}
+	if *findSubvolumes || rootGlob != nil {
+		paths = nil
+	}
+	if *pathsFile != "" {
+		var err error
+		paths, err = readPathsFile(*pathsFile)
+		if err != nil {
+			fatalf(exitConfig, "Failed to read paths file: %v", err)
+		}
+	}
+	// Discovered paths are only known once walking
+	for path := range pathTTLs {
+		if contains(paths, path) {
+			continue
+		}
+		if !*findSubvolumes && rootGlob == nil {
+			fatalf(exitConfig, "Path in PATH_CACHE_TTL is not monitored: %s", path)
+		}
+		log.Printf("Path in PATH_CACHE_TTL is not in the monitored paths, it will only be cached if discovered: %s", path)
+	}
+
+	conn, err := rados.NewConnWithUser(*cephUser)
+	if err != nil {
+		fatalf(exitConnect, "Failed to create rados connection: %v", err)
+	}
+	if *cephConfigContent != "" {
+		err = readConfigContent(conn, *cephConfigContent)
+	} else {
+		err = readConfigFile(conn, *cephConfig, *configWait)
+	}
+	if err != nil {
+		fatalf(exitConfig, "Failed to read config file: %s", err)
+	}
+
+	err = conn.ReadDefaultConfigFile()
+	if err != nil {
+		fatalf(exitConfig, "Failed to read config file: %v", err)
+	}
+
+	// Originate connections from a specific address, which clients only do
+	// if they bind before connecting
+	if *cephClientAddr != "" {
+		if net.ParseIP(*cephClientAddr) == nil {
+			fatalf(exitConfig, "Invalid CEPH_CLIENT_ADDR: %s", *cephClientAddr)
+		}
+		err = conn.SetConfigOption("public_addr", *cephClientAddr)
+		if err == nil {
+			err = conn.SetConfigOption("ms_bind_before_connect", "true")
+		}
+		if err != nil {
+			fatalf(exitConnect, "Failed to set client address: %v", err)
+		}
+	}
+
+	// Identify our sessions in "ceph tell mds.* session ls"
+	if *clientIDTag != "" {
+		if strings.ContainsAny(*clientIDTag, ",= ") {
+			fatalf(exitConfig, "Invalid CLIENT_ID_TAG, can't contain commas, equal signs or spaces: %s", *clientIDTag)
+		}
+		err = conn.SetConfigOption("client_metadata", "cephfs_exporter="+*clientIDTag)
+		if err != nil {
+			fatalf(exitConnect, "Failed to set client metadata: %v", err)
+		}
+	}
+
+	// Use the key from the environment rather than a keyring; never log it
+	if *cephKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(*cephKey); err != nil {
+			log.Print("CEPH_KEY is not valid base64, authentication will probably fail")
+		}
+		err = conn.SetConfigOption("key", *cephKey)
+		if err != nil {
+			fatalf(exitConnect, "Failed to set key")
+		}
+	}
+
+	// Retry in case the mons are restarting
+	err = retry("connect to the cluster", *connectRetries, *retryInterval, conn.Connect)
+	if err != nil {
+		fatalf(exitConnect, "Failed to connect to the cluster: %v", err)
+	}
+	defer conn.Shutdown()
+	log.Print("Successfully connected to Ceph cluster!")
+
+	// Mount the default filesystem, or each of the listed filesystems, all
+	// from the same connection
+	fsNames := splitList(*cephFSNames)
+	if len(fsNames) == 0 {
+		fsNames = []string{""}
+	}
+
+	// Before any walk starts
+	directoryDepth = newDirectoryDepth(*recurseMaxLevels)
+
+	// Use our own registry rather than the global one, with the same Go and
+	// process metrics
+	registry := prometheus.NewRegistry()
+	var registerer prometheus.Registerer = registry
+
+	// Label every metric with the cluster
+	if *emitFSIDLabel {
+		fsid, err := conn.GetFSID()
+		if err != nil {
+			fatalf(exitConnect, "Failed to get cluster fsid: %v", err)
+		}
+		log.Printf("Cluster fsid: %s", fsid)
+		registerer = prometheus.WrapRegistererWith(
+			prometheus.Labels{"fsid": fsid},
+			registerer,
+		)
+	}
+
+	registerer.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	var collectors []*Collector
+	for _, fsName := range fsNames {
+		var filesystem *cephfs.MountInfo
+		err := retry("mount the filesystem", *connectRetries, *retryInterval, func() error {
+			var err error
+			filesystem, err = mountFilesystem(conn, fsName)
+			return err
+		})
+		if err != nil {
+			fatalf(exitMount, "%v", err)
+		}
+		defer unmountFilesystem(filesystem)
+		if fsName == "" {
+			log.Print("Successfully mounted Ceph filesystem!")
+		} else {
+			log.Printf("Successfully mounted Ceph filesystem %s!", fsName)
+		}
+
+		collector := &Collector{
+			filesystem:     filesystem,
+			filesystemName: fsName,
+			paths:          paths,
+			walkConfig: walkConfig{
+				recurseMinSize:   *recurseMinSize,
+				recurseMaxLevels: *recurseMaxLevels,
+				recurseStrategy:  *recurseStrategy,
+				leavesOnly:       *leavesOnly,
+				countChildren:    *countChildren,
+				skipEmptyDirs:    *skipEmptyDirs,
+				skipRootPath:     *skipRootPath,
+				emitMinEntries:   *emitMinEntries,
+				excludeName:      excludeName,
+				maxEntriesPerDir: *maxEntriesPerDir,
+				maxSeries:        *maxSeries,
+				filterUID:        *filterUID,
+				filterGID:        *filterGID,
+				filterPrune:      *filterPrune,
+				emitObjects:      *emitObjects,
+				recurseByRank:    *recurseByRank,
+				subtreeWorkers:   *subtreeWorkers,
+				trackLargeFiles:  *trackLargeFiles,
+				largeFileMinSize: *largeFileMinSize,
+				readDirPlus:      *readDirPlus,
+				minChangePercent: *minChangePercent,
+				modifiedSince:    *modifiedSince,
+				coldDataAge:      coldDataAge,
+				emitLocalBytes:   *emitLocalBytes,
+				emitLayout:       *emitLayout,
+				emitStatx:        *emitStatx,
+				emitQuota:        *emitQuota,
+				timestampXattrs:  timestampXattrs,
+				markTruncated:    *markTruncated,
+				relpathLabel:     *relpathLabel,
+				pathComponents:   *componentsLabel,
+				hashPathLabels:   *hashPathLabels,
+				hashKeepLevels:   *hashKeepLevels,
+				pathLabelStyle:   *pathLabelStyle,
+				disabledMetrics:  disabled,
+			},
+			emitRbytesDelta: *emitRbytesDelta,
+			emitDirChanged:  *emitDirChanged,
+			snapshotPrefix:  *snapshotPrefix,
+			overheadPaths:   overheadPaths,
+			ageBuckets:      ageBuckets,
+			findSubvolumes:  *findSubvolumes,
+			groupTotals:     *groupTotals,
+			rootGlob:        rootGlob,
+			rootGlobMax:     *rootGlobMax,
+			emitRootTotal:   *emitRootTotal,
+			bestEffort:      *bestEffort,
+			serveTLS:        *tlsCertFile != "",
+			pausable:        *pauseToken != "" || *startPaused,
+			pauseEndpoint:   *pauseToken != "",
+			reloadEndpoint:  *walkOnce && *reloadToken != "",
+			quitEndpoint:    *quitToken != "",
+
+			cacheTTL:            *cacheTTL,
+			walkOnce:            *walkOnce,
+			cacheTimestamps:     *cacheTimestamps,
+			mdsLatencyThreshold: *latencyThreshold,
+			mdsLatencyWindow:    *latencyWindow,
+			pathTTLs:            pathTTLs,
+
+			lastSuccess: time.Now(),
+			lastMount:   time.Now(),
+			pathCaches:  make(map[string]*pathCache),
+			globMatches: -1,
+		}
+		if *emitDirInfo {
+			// Only keep the path label on the numeric metrics
+			collector.dirInfoDesc = newDirInfoDesc(*relpathLabel, *markTruncated, *componentsLabel, *recurseByRank, *emitLayout)
+			collector.rbytesDesc, collector.rentriesDesc = dirDescs(false, false, false)
+		} else {
+			collector.rbytesDesc, collector.rentriesDesc = dirDescs(*markTruncated, *relpathLabel, *componentsLabel)
+		}
+		collector.setPaused(*startPaused)
+		// Extra mounts, so concurrent walks don't share one
+		if *mountPoolSize > 1 {
+			collector.mounts = make(chan fsClient, *mountPoolSize)
+			collector.mounts <- cephClient{filesystem}
+			for i := 1; i < *mountPoolSize; i++ {
+				extra, err := mountFilesystem(conn, fsName)
+				if err != nil {
+					fatalf(exitMount, "%v", err)
+				}
+				defer unmountFilesystem(extra)
+				collector.mounts <- cephClient{extra}
+			}
+		}
+		// Serve the metrics saved before the restart while walking again
+		if *cacheFile != "" {
+			path := cacheFilePath(*cacheFile, fsName)
+			if err := collector.loadCacheFile(path); err != nil {
+				log.Printf("Not using cache file %s: %v", path, err)
+			} else {
+				log.Printf("Loaded cache file %s", path)
+				collector.refresh()
+			}
+		}
+		if *maxScrapes > 0 {
+			collector.scrapeSlots = make(chan struct{}, *maxScrapes)
+		}
+		if err := collector.probeRecursiveStats(); err != nil {
+			fatalf(exitSelfTest, "%v", err)
+		}
+		if !collector.selfTest() && *selfTestStrict {
+			fatalf(exitSelfTest, "Self-test failed, some xattrs can't be read")
+		}
+		if fsName == "" {
+			registerer.MustRegister(collector)
+		} else {
+			prometheus.WrapRegistererWith(
+				prometheus.Labels{"filesystem": fsName},
+				registerer,
+			).MustRegister(collector)
+		}
+		collectors = append(collectors, collector)
+	}
+	// The counters shared by the collectors are still updated when disabled,
+	// just not registered
+	for name, metric := range map[string]prometheus.Collector{
+		"cephfs_xattr_reads_total":        xattrReads,
+		"cephfs_dir_entries_read_total":   dirEntriesRead,
+		"cephfs_directory_depth":          directoryDepth,
+		"cephfs_active_mounts":            activeMounts,
+		"cephfs_metrics_suppressed_total": metricsSuppressed,
+	} {
+		if !disabled[name] {
+			registerer.MustRegister(metric)
+		}
+	}
+	if *pathsFile != "" {
+		go watchPathsFile(*pathsFile, *pathsInterval, collectors)
+	}
+
+	if *enableFSStatus {
+		registerer.MustRegister(&FSStatusCollector{conn: conn, disabledMetrics: disabled})
+	}
+	if *enablePools {
+		registerer.MustRegister(&PoolCollector{conn: conn, disabledMetrics: disabled})
+	}
+	if *monRTTInterval > 0 && !disabled["cephfs_mon_rtt_seconds"] {
+		registerer.MustRegister(monRTT)
+		measureMonRTT(conn)
+		go measureMonRTTEvery(conn, *monRTTInterval)
+	}
+
+	// Collect once and push, instead of serving
+	if *pushgatewayURL != "" {
+		pusher := push.New(*pushgatewayURL, *pushgatewayJob).Gatherer(registry)
+		labels, err := parseLabels(*pushgatewayLabels)
+		if err != nil {
+			fatalf(exitConfig, "Invalid PUSHGATEWAY_LABELS: %v", err)
+		}
+		for name, value := range labels {
+			pusher = pusher.Grouping(name, value)
+		}
+		if err := pusher.Push(); err != nil {
+			fatalf(exitPush, "Failed to push to %s: %v", *pushgatewayURL, err)
+		}
+		log.Printf("Pushed metrics to %s", *pushgatewayURL)
+		return
+	}
+
+	// Also send the metrics with remote write
+	if *remoteWriteURL != "" {
+		labels, err := parseLabels(*remoteWriteLabels)
+		if err != nil {
+			fatalf(exitConfig, "Invalid REMOTE_WRITE_LABELS: %v", err)
+		}
+		writer := &remoteWriter{
+			url:      *remoteWriteURL,
+			username: *remoteWriteUser,
+			password: *remoteWritePass,
+			labels:   labels,
+			gatherer: registry,
+			client:   &http.Client{Timeout: *remoteWriteEvery},
+		}
+		go writer.run(*remoteWriteEvery, *collectJitter)
+	}
+
+	// Compress responses if the scraper accepts it, which is the case of
+	// Prometheus
+	handlerOpts := promhttp.HandlerOpts{}
+	offered := splitList(*compression)
+	if len(offered) == 0 {
+		handlerOpts.DisableCompression = true
+	}
+	for _, encoding := range offered {
+		switch promhttp.Compression(encoding) {
+		case promhttp.Gzip, promhttp.Zstd, promhttp.Identity:
+			handlerOpts.OfferedCompressions = append(handlerOpts.OfferedCompressions, promhttp.Compression(encoding))
+		default:
+			fatalf(exitConfig, "Invalid encoding in TELEMETRY_COMPRESSION: %s", encoding)
+		}
+	}
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		registerer,
+		promhttp.HandlerFor(registry, handlerOpts),
+	))
+	http.HandleFunc("/-/config", serveConfig(collectors))
+	if *walkOnce {
+		if *reloadToken != "" {
+			http.HandleFunc("/-/reload", serveReload(*reloadToken, collectors))
+		}
+		go refreshOnSignal(collectors)
+	}
+	quit := make(chan struct{})
+	if *quitToken != "" {
+		http.HandleFunc("/-/quit", serveQuit(*quitToken, quit))
+	}
+	if *pauseToken != "" {
+		http.HandleFunc("/-/pause", servePause(*pauseToken, true, collectors))
+		http.HandleFunc("/-/resume", servePause(*pauseToken, false, collectors))
+	}
+
+	if *metricsNetwork != "tcp" && *metricsNetwork != "tcp4" && *metricsNetwork != "tcp6" {
+		fatalf(exitConfig, "Invalid TELEMETRY_NETWORK: %s", *metricsNetwork)
+	}
+	listener, err := net.Listen(*metricsNetwork, *metricsAddr)
+	if err != nil {
+		fatalf(exitServe, "Failed to listen on %s: %v", *metricsAddr, err)
+	}
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		if *tlsCertFile == "" || *tlsKeyFile == "" {
+			fatalf(exitConfig, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		reloader, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			fatalf(exitConfig, "Failed to load TLS certificate: %v", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+		})
+	}
+
+	var handler http.Handler = http.DefaultServeMux
+	if *logRequestsFlag {
+		handler = logRequests(handler)
+	}
+
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+
+	if *cacheFile != "" || *quitToken != "" {
+		go shutdownOnSignal(server, quit)
+	}
+
+	log.Printf("Starting server on %s (%s)\n", listener.Addr(), *metricsNetwork)
+	err = server.Serve(listener)
+	if err != http.ErrServerClosed {
+		fatalf(exitServe, "%v", err)
+	}
+
+	if *cacheFile != "" {
+		for _, collector := range collectors {
+			path := cacheFilePath(*cacheFile, collector.filesystemName)
+			if err := collector.saveCacheFile(path); err != nil {
+				log.Printf("Failed to save cache file %s: %v", path, err)
+			}
+		}
+	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatherRbytes collects from a Collector, returning the paths with a
+// cephfs_rbytes metric
+func gatherRbytes(c *Collector) ([]string, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return nil, err
+	}
+	families, err := registry.Gather()
+	paths := []string{}
+	for _, family := range families {
+		if family.GetName() != "cephfs_rbytes" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "path" {
+					paths = append(paths, label.GetValue())
+				}
+			}
+		}
+	}
+	return paths, err
+}
+
+func TestBestEffort(t *testing.T) {
+	// The second path doesn't exist, so the walk fails
+	c := testCollector(newFakeFS(testTree))
+	c.paths = []string{"/a", "/missing"}
+	c.bestEffort = true
+	paths, err := gatherRbytes(c)
+	if err != nil {
+		t.Fatalf("Got error with BEST_EFFORT: %v", err)
+	}
+	checkPaths(t, paths, []string{"/a", "/a/x"})
+
+	// The scrape fails, which Prometheus reports as up 0
+	c = testCollector(newFakeFS(testTree))
+	c.paths = []string{"/a", "/missing"}
+	c.bestEffort = false
+	_, err = gatherRbytes(c)
+	if err == nil || !strings.Contains(err.Error(), "errno 2") {
+		t.Fatalf("Got error %v without BEST_EFFORT, expected the walk error", err)
+	}
+
+	// No error if the walk succeeds
+	c = testCollector(newFakeFS(testTree))
+	c.paths = []string{"/a"}
+	c.bestEffort = false
+	if _, err := gatherRbytes(c); err != nil {
+		t.Fatalf("Got error %v without BEST_EFFORT, expected none", err)
+	}
+}
+
+func TestPauseKeepsMetrics(t *testing.T) {
+	c := testCollector(newFakeFS(testTree))
+	c.paths = []string{"/a"}
+	c.pausable = true
+	if _, err := gatherRbytes(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// While paused, the last walk is served without walking the new paths
+	c.setPaused(true)
+	c.paths = []string{"/b"}
+	paths, err := gatherRbytes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, paths, []string{"/a", "/a/x"})
+
+	// Along with cephfs_paused, and nothing else
+	expected := map[string]bool{"cephfs_paused": true}
+	for _, metric := range c.cachedMetrics {
+		expected[descName.FindStringSubmatch(metric.Desc().String())[1]] = true
+	}
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	paused := false
+	for metric := range ch {
+		name := descName.FindStringSubmatch(metric.Desc().String())[1]
+		if !expected[name] {
+			t.Errorf("Got %s while paused", name)
+		}
+		paused = paused || formatMetric(metric) == "cephfs_paused{} 1"
+	}
+	if !paused {
+		t.Error("Missing cephfs_paused 1")
+	}
+
+	c.setPaused(false)
+	paths, err = gatherRbytes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, paths, []string{"/b"})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	rados "github.com/ceph/go-ceph/rados"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var monRTT = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cephfs_mon_rtt_seconds",
+	Help: "Time taken by the last cheap command sent to the monitors, to tell network issues from MDS slowness",
+})
+
+// measureMonRTT times a command that only needs a round-trip to the monitors
+func measureMonRTT(conn *rados.Conn) {
+	start := time.Now()
+	_, _, err := conn.MonCommand([]byte(`{"prefix": "fsid", "format": "json"}`))
+	if err != nil {
+		log.Printf("Measuring monitor round-trip: %v", err)
+		return
+	}
+	monRTT.Set(time.Since(start).Seconds())
+}
+
+// measureMonRTTEvery measures the monitor round-trip on a timer, rather than
+// on each scrape
+func measureMonRTTEvery(conn *rados.Conn, interval time.Duration) {
+	for range time.Tick(interval) {
+		measureMonRTT(conn)
+	}
+}
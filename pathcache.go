@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pathCache holds the metrics of the last walk of a path with its own TTL
+type pathCache struct {
+	metrics       []prometheus.Metric
+	dirs          []string
+	topLevelPaths []string
+	time          time.Time
+}
+
+// parsePathTTLs parses a comma-separated list of path=duration
+func parsePathTTLs(value string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for _, item := range splitList(value) {
+		path, ttlStr, ok := strings.Cut(item, "=")
+		if !ok || !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("Invalid path TTL %q", item)
+		}
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid path TTL %q: %w", item, err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("Invalid path TTL %q, must be positive", item)
+		}
+		path = filepath.Clean(path)
+		if _, ok := ttls[path]; ok {
+			return nil, fmt.Errorf("Duplicate path %s", path)
+		}
+		ttls[path] = ttl
+	}
+	return ttls, nil
+}
+
+// replayPath emits the cached metrics of a path, if it has its own TTL and
+// it hasn't expired
+func (c *Collector) replayPath(path string, col *collection) bool {
+	ttl, ok := c.pathTTLs[path]
+	if !ok {
+		return false
+	}
+
+	c.mutex.Lock()
+	cache := c.pathCaches[path]
+	c.mutex.Unlock()
+	if cache == nil || time.Since(cache.time) >= ttl {
+		return false
+	}
+
+	// Mark the directories as emitted, in case another path overlaps
+	for _, dir := range cache.dirs {
+		col.emitted[dir] = true
+	}
+	col.topLevelPaths = append(col.topLevelPaths, cache.topLevelPaths...)
+	for _, metric := range cache.metrics {
+		col.emit(metric)
+	}
+	return true
+}
+
+// startCapture starts keeping the metrics emitted for a path, if it has its
+// own TTL
+func (c *Collector) startCapture(path string, col *collection) {
+	if _, ok := c.pathTTLs[path]; ok {
+		col.capture = &pathCache{metrics: []prometheus.Metric{}}
+	}
+}
+
+// endCapture caches the metrics captured for a path, if it was walked
+// successfully
+func (c *Collector) endCapture(path string, col *collection, err error) {
+	cache := col.capture
+	col.capture = nil
+	if cache == nil || err != nil {
+		return
+	}
+	cache.time = time.Now()
+
+	c.mutex.Lock()
+	c.pathCaches[path] = cache
+	c.mutex.Unlock()
+}
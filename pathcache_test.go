@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParsePathTTLs(t *testing.T) {
+	ttls, err := parsePathTTLs("/scratch/=30s, /archive//old=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Duration{
+		"/scratch":     30 * time.Second,
+		"/archive/old": time.Hour,
+	}
+	if !reflect.DeepEqual(ttls, expected) {
+		t.Errorf("Got %v, expected %v", ttls, expected)
+	}
+
+	for _, value := range []string{"scratch=30s", "/scratch", "/scratch=0s", "/scratch=1m,/scratch/=1h"} {
+		if _, err := parsePathTTLs(value); err == nil {
+			t.Errorf("No error parsing %q", value)
+		}
+	}
+}
+
+func TestPathCacheTopLevelPaths(t *testing.T) {
+	c := testCollector(newFakeFS(testTree))
+	c.paths = []string{"/", "/a"}
+	c.pathTTLs = map[string]time.Duration{"/a": time.Hour}
+
+	// The second walk replays /a, its top-level directories are still listed
+	for i := 0; i < 2; i++ {
+		if _, err := gatherRbytes(c); err != nil {
+			t.Fatal(err)
+		}
+		topLevelPaths := c.configInfo().TopLevelPaths
+		sort.Strings(topLevelPaths)
+		checkPaths(t, topLevelPaths, []string{"/a", "/a/x", "/b"})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readPathsFile reads the list of paths to monitor, one per line, ignoring
+// blank lines and comments
+func readPathsFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			return nil, fmt.Errorf("Path is not absolute: %s", line)
+		}
+		paths = append(paths, filepath.Clean(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// watchPathsFile re-reads the paths file periodically and on SIGHUP, updating
+// the collectors
+func watchPathsFile(name string, interval time.Duration, collectors []*Collector) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-hup:
+			log.Print("Got SIGHUP, reloading paths file")
+		}
+
+		paths, err := readPathsFile(name)
+		if err != nil {
+			log.Printf("Failed to reload paths file: %v", err)
+			continue
+		}
+		for _, c := range collectors {
+			if !equalPaths(c.getPaths(), paths) {
+				log.Printf("Monitored paths changed: %s", strings.Join(paths, ", "))
+			}
+			c.setPaths(paths)
+		}
+	}
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pausedDesc = prometheus.NewDesc(
+	"cephfs_paused",
+	"Whether walking is paused with /-/pause, serving cached data",
+	nil, nil,
+)
+
+func (c *Collector) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) != 0
+}
+
+// emitPaused emits cephfs_paused, which is also the only metric emitted with
+// the cached ones while paused
+func (c *Collector) emitPaused(ch chan<- prometheus.Metric, paused bool) {
+	if !c.metricEnabled("cephfs_paused") {
+		return
+	}
+	value := 0.0
+	if paused {
+		value = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		pausedDesc,
+		prometheus.GaugeValue,
+		value,
+	)
+}
+
+func (c *Collector) setPaused(paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	atomic.StoreInt32(&c.paused, value)
+}
+
+// checkToken returns whether the request has the right bearer token,
+// replying with an error if not
+func checkToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// servePause pauses or resumes walking on POST with the right bearer token
+func servePause(token string, paused bool, collectors []*Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkToken(w, r, token) {
+			return
+		}
+
+		if paused {
+			log.Print("Pausing, serving cached metrics until resumed")
+		} else {
+			log.Print("Resuming")
+		}
+		for _, c := range collectors {
+			c.setPaused(paused)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dirPinDesc = prometheus.NewDesc(
+	"cephfs_dir_pin",
+	"MDS rank the directory is pinned to, from its ceph.dir.pin or the one it inherits from a walked parent, -1 if not pinned",
+	[]string{"path"}, nil,
+)
+
+// lookupPin returns the pin of a directory if it was already read, by this
+// collection or the one it was forked from
+func (col *collection) lookupPin(path string) (int64, bool) {
+	if pin, ok := col.pins[path]; ok {
+		return pin, true
+	}
+	if col.parent != nil {
+		return col.parent.lookupPin(path)
+	}
+	return 0, false
+}
+
+// readPin returns the MDS rank a directory is pinned to. ceph.dir.pin is -1
+// unless set on the directory itself, in which case the pin of the parent
+// applies, if we read it
+func (c *walkConfig) readPin(path string, col *collection) (int64, error) {
+	if pin, ok := col.lookupPin(path); ok {
+		return pin, nil
+	}
+
+	pin := int64(-1)
+	value, err := getXattr(col.filesystem, path, "ceph.dir.pin")
+	if err == nil {
+		pin, err = strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid pin %q", value)
+		}
+	} else if !isNoAttribute(err) && !isPermissionDenied(err) {
+		return 0, fmt.Errorf("Getting pin: %w", err)
+	}
+	if pin < 0 {
+		if parentPin, ok := col.lookupPin(filepath.Dir(path)); ok {
+			pin = parentPin
+		}
+	}
+	col.pins[path] = pin
+	return pin, nil
+}
+
+// sortByRank orders subdirectories by the MDS rank they are pinned to, those
+// on the same rank as their parent first, so the walk stays on one MDS as
+// long as possible
+func (c *walkConfig) sortByRank(dir *dirStats, subdirs []string, col *collection) error {
+	keys := make(map[string]int64, len(subdirs))
+	for _, subdir := range subdirs {
+		pin, err := c.readPin(subdir, col)
+		if err != nil {
+			return err
+		}
+		if pin == dir.pin {
+			pin = -2
+		}
+		keys[subdir] = pin
+	}
+	sort.SliceStable(subdirs, func(i, j int) bool {
+		return keys[subdirs[i]] < keys[subdirs[j]]
+	})
+	return nil
+}
@@ -0,0 +1,17 @@
+package main
+
+// getMount checks out a mount for a walk, waiting if all the mounts are in
+// use. Without a pool, all walks share the main mount
+func (c *Collector) getMount() fsClient {
+	if c.mounts == nil {
+		return cephClient{c.filesystem}
+	}
+	return <-c.mounts
+}
+
+// putMount gives back a mount checked out by getMount
+func (c *Collector) putMount(filesystem fsClient) {
+	if c.mounts != nil {
+		c.mounts <- filesystem
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// BenchmarkMountPool runs concurrent walks on a single mount, where the MDS
+// requests are serialized, and on a pool of mounts, one per walk
+func BenchmarkMountPool(b *testing.B) {
+	tree := benchmarkTree(3, 3)
+	newMount := func() fsClient {
+		fs := newFakeFS(tree)
+		fs.latency = 10 * time.Microsecond
+		return fs
+	}
+
+	b.Run("shared", func(b *testing.B) {
+		c := testCollector(newMount())
+		b.SetParallelism(4)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.walk(nil)
+			}
+		})
+	})
+	b.Run("pool", func(b *testing.B) {
+		c := testCollector(newMount(), newMount(), newMount(), newMount())
+		b.SetParallelism(4)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.walk(nil)
+			}
+		})
+	})
+}
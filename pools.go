@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	rados "github.com/ceph/go-ceph/rados"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dataPoolInfoDesc = prometheus.NewDesc(
+		"cephfs_data_pool_info",
+		"Data pools of each filesystem",
+		[]string{"filesystem", "pool"}, nil,
+	)
+	dataPoolUsedDesc = prometheus.NewDesc(
+		"cephfs_data_pool_used_bytes",
+		"Raw space used by a data pool of the filesystem, including replication",
+		[]string{"filesystem", "pool"}, nil,
+	)
+)
+
+// fsList is the part of the output of "ceph fs ls" that we use
+type fsList []struct {
+	Name      string   `json:"name"`
+	DataPools []string `json:"data_pools"`
+}
+
+// poolDF is the part of the output of "ceph df" that we use
+type poolDF struct {
+	Pools []struct {
+		Name  string `json:"name"`
+		Stats struct {
+			BytesUsed uint64 `json:"bytes_used"`
+		} `json:"stats"`
+	} `json:"pools"`
+}
+
+// PoolCollector exports the data pools backing each filesystem and their
+// usage, from the monitors
+type PoolCollector struct {
+	prometheus.Collector
+	conn            *rados.Conn
+	disabledMetrics map[string]bool
+}
+
+func (c *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dataPoolInfoDesc
+	ch <- dataPoolUsedDesc
+}
+
+func (c *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	var filesystems fsList
+	if err := c.monCommand("fs ls", &filesystems); err != nil {
+		log.Print(err)
+		return
+	}
+	var df poolDF
+	if err := c.monCommand("df", &df); err != nil {
+		log.Print(err)
+		return
+	}
+	used := make(map[string]uint64, len(df.Pools))
+	for _, pool := range df.Pools {
+		used[pool.Name] = pool.Stats.BytesUsed
+	}
+
+	for _, fs := range filesystems {
+		for _, pool := range fs.DataPools {
+			if metricEnabled(c.disabledMetrics, "cephfs_data_pool_info") {
+				ch <- prometheus.MustNewConstMetric(
+					dataPoolInfoDesc,
+					prometheus.GaugeValue,
+					1,
+					fs.Name,
+					pool,
+				)
+			}
+			if bytes, ok := used[pool]; ok && metricEnabled(c.disabledMetrics, "cephfs_data_pool_used_bytes") {
+				ch <- prometheus.MustNewConstMetric(
+					dataPoolUsedDesc,
+					prometheus.GaugeValue,
+					float64(bytes),
+					fs.Name,
+					pool,
+				)
+			}
+		}
+	}
+}
+
+func (c *PoolCollector) monCommand(prefix string, result interface{}) error {
+	cmd, err := json.Marshal(map[string]string{
+		"prefix": prefix,
+		"format": "json",
+	})
+	if err != nil {
+		return err
+	}
+	out, info, err := c.conn.MonCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("Getting %s: %w (%s)", prefix, err, info)
+	}
+	if err := json.Unmarshal(out, result); err != nil {
+		return fmt.Errorf("Parsing %s: %w", prefix, err)
+	}
+	return nil
+}
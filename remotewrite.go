@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriter sends the gathered metrics to a Prometheus remote write
+// endpoint at an interval
+type remoteWriter struct {
+	url      string
+	username string
+	password string
+	labels   prometheus.Labels
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+func (w *remoteWriter) run(interval time.Duration, jitter time.Duration) {
+	// Delay each write by a random part of the jitter, so replicas started
+	// at the same time don't all walk at once
+	rng := rand.New(rand.NewSource(jitterSeed()))
+	next := time.Now()
+	for {
+		delay := time.Until(next)
+		if jitter > 0 {
+			delay += time.Duration(rng.Int63n(int64(jitter)))
+		}
+		time.Sleep(delay)
+		if err := w.write(); err != nil {
+			log.Printf("Remote write to %s failed: %v", w.url, err)
+		}
+		next = next.Add(interval)
+	}
+}
+
+// jitterSeed seeds the jitter from the hostname and pid, so it is different
+// for each replica but doesn't change while running
+func jitterSeed() int64 {
+	hostname, _ := os.Hostname()
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s/%d", hostname, os.Getpid())
+	return int64(hash.Sum64())
+}
+
+func (w *remoteWriter) write() error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("Gathering metrics: %w", err)
+	}
+	body := snappy.Encode(nil, w.encode(families, time.Now()))
+
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.username != "" {
+		request.SetBasicAuth(w.username, w.password)
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("Server returned %s", response.Status)
+	}
+	return nil
+}
+
+// encode builds a remote write WriteRequest. It is encoded by hand, since
+// the message is simple:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func (w *remoteWriter) encode(families []*dto.MetricFamily, now time.Time) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var request []byte
+	series := func(name string, m *dto.Metric, value float64, extra ...string) {
+		labels := map[string]string{"__name__": name}
+		for name, value := range w.labels {
+			labels[name] = value
+		}
+		for _, label := range m.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels[extra[i]] = extra[i+1]
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encodeSeries(labels, value, timestamp))
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				series(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				series(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				series(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.Quantile {
+					series(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				series(name+"_sum", m, summary.GetSampleSum())
+				series(name+"_count", m, float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				for _, b := range histogram.Bucket {
+					series(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				series(name+"_bucket", m, float64(histogram.GetSampleCount()), "le", "+Inf")
+				series(name+"_sum", m, histogram.GetSampleSum())
+				series(name+"_count", m, float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return request
+}
+
+// encodeSeries encodes a TimeSeries with a single sample, labels have to be
+// sorted by name
+func encodeSeries(labels map[string]string, value float64, timestamp int64) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var series []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	return series
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests wraps a handler to log each request once it's been served
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		log.Printf("%s %s from %s: %d in %s", r.Method, r.URL.Path, r.RemoteAddr, recorder.status, time.Since(start))
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Longest wait between two attempts of retry
+const maxRetryInterval = time.Minute
+
+// retry calls fn until it succeeds, up to retries more times, waiting interval
+// after the first failure and twice as long after each of the next ones
+func retry(what string, retries int, interval time.Duration, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		log.Printf("Failed to %s (attempt %d of %d), retrying in %v: %v", what, attempt+1, retries+1, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// probeRecursiveStats checks that the recursive accounting xattrs can be read
+// on the root directory. Without them nothing can be exported, so this fails
+// regardless of SELF_TEST_STRICT; other errors are left to the self-test
+func (c *Collector) probeRecursiveStats() error {
+	_, err := getXattr(cephClient{c.filesystem}, "/", "ceph.dir.rbytes")
+	if err != nil && isNoAttribute(err) {
+		return fmt.Errorf("No ceph.dir.rbytes on the root directory: %w. The recursive accounting xattrs (ceph.dir.rbytes, ceph.dir.rentries) are required, they might be disabled on this cluster or unsupported by the MDS", err)
+	}
+	return nil
+}
+
+// selfTest reads each xattr the collector uses on the root directory, logging
+// the result of each read, and returns whether they could all be read
+func (c *Collector) selfTest() bool {
+	xattrs := []string{"ceph.dir.rbytes", "ceph.dir.rentries"}
+	if c.emitDirChanged || c.modifiedSince > 0 || c.coldDataAge > 0 {
+		xattrs = append(xattrs, "ceph.dir.rctime")
+	}
+	if c.emitLayout {
+		xattrs = append(xattrs, "ceph.dir.layout")
+	}
+	for _, xattr := range c.timestampXattrs {
+		if !contains(xattrs, xattr.name) {
+			xattrs = append(xattrs, xattr.name)
+		}
+	}
+
+	ok := true
+	for _, xattr := range xattrs {
+		_, err := getXattr(cephClient{c.filesystem}, "/", xattr)
+		if err != nil && !(xattr == "ceph.dir.layout" && isNoAttribute(err)) {
+			log.Printf("Self-test: can't read %s: %v", xattr, err)
+			ok = false
+		} else {
+			log.Printf("Self-test: read %s", xattr)
+		}
+	}
+	return ok
+}
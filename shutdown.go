@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// shutdownOnSignal stops the server on SIGTERM or SIGINT, or when quit is
+// closed, so the cache can be saved and the filesystems unmounted before
+// exiting
+func shutdownOnSignal(server *http.Server, quit <-chan struct{}) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case <-stop:
+		log.Print("Shutting down")
+	case <-quit:
+		log.Print("Quit requested, shutting down")
+	}
+	server.Shutdown(context.Background())
+}
+
+// serveQuit closes quit on POST with the right bearer token, which does the
+// same graceful shutdown as SIGTERM once the response is sent
+func serveQuit(token string, quit chan<- struct{}) http.HandlerFunc {
+	var once sync.Once
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkToken(w, r, token) {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		once.Do(func() { close(quit) })
+	}
+}
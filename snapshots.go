@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	snapshotRbytesDesc = prometheus.NewDesc(
+		"cephfs_snapshot_rbytes",
+		"Total size of directory in bytes, as of a snapshot",
+		[]string{"path", "snapshot"}, nil,
+	)
+	snapshotOverheadDesc = prometheus.NewDesc(
+		"cephfs_snapshot_overhead_bytes",
+		"Sum of the sizes of all the snapshots of the directory, an upper bound of the space they hold",
+		[]string{"path"}, nil,
+	)
+)
+
+// snapshotSize is the size of a directory as of one of its snapshots
+type snapshotSize struct {
+	name   string
+	rbytes uint64
+}
+
+// readSnapshots returns the size of a directory in each of its snapshots
+// whose name starts with prefix
+func (c *Collector) readSnapshots(path string, prefix string, col *collection) ([]snapshotSize, error) {
+	snapDir := filepath.Join(path, ".snap")
+	handle, err := col.filesystem.OpenDir(snapDir)
+	if err != nil {
+		return nil, fmt.Errorf("Opening snapshot directory: %w", err)
+	}
+	defer handle.Close()
+
+	var sizes []snapshotSize
+	for {
+		entry, err := handle.ReadDir()
+		if err != nil {
+			return nil, fmt.Errorf("Reading snapshot directory: %w", err)
+		}
+		if entry == nil {
+			break
+		}
+		name := entry.Name()
+		if name == "." || name == ".." || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		rbytes, err := col.getNumXattr(col.filesystem, filepath.Join(snapDir, name), "ceph.dir.rbytes")
+		if err != nil {
+			return nil, fmt.Errorf("Getting rbytes of snapshot %s: %w", name, err)
+		}
+		sizes = append(sizes, snapshotSize{name: name, rbytes: rbytes})
+	}
+	return sizes, nil
+}
+
+// observeSnapshots emits the size of a directory in each of its snapshots
+// whose name starts with the configured prefix
+func (c *Collector) observeSnapshots(path string, col *collection) error {
+	sizes, err := c.readSnapshots(path, c.snapshotPrefix, col)
+	if err != nil {
+		return err
+	}
+	for _, size := range sizes {
+		col.emit(prometheus.MustNewConstMetric(
+			snapshotRbytesDesc,
+			prometheus.GaugeValue,
+			float64(size.rbytes),
+			c.pathLabel(path),
+			size.name,
+		))
+	}
+	return nil
+}
+
+// observeSnapshotOverhead emits the total size of all the snapshots of a
+// directory. Snapshots share the data that didn't change, so this is how
+// much they could hold if all of it was deleted or rewritten
+func (c *Collector) observeSnapshotOverhead(path string, col *collection) error {
+	sizes, err := c.readSnapshots(path, "", col)
+	if err != nil {
+		return err
+	}
+	var total uint64
+	for _, size := range sizes {
+		total += size.rbytes
+	}
+	col.emit(prometheus.MustNewConstMetric(
+		snapshotOverheadDesc,
+		prometheus.GaugeValue,
+		float64(total),
+		c.pathLabel(path),
+	))
+	return nil
+}
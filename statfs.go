@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statfsTotalDesc = prometheus.NewDesc(
+		"cephfs_statfs_total_bytes",
+		"Size of the filesystem in bytes, from statfs",
+		nil, nil,
+	)
+	statfsFreeDesc = prometheus.NewDesc(
+		"cephfs_statfs_free_bytes",
+		"Free space in the filesystem in bytes, from statfs",
+		nil, nil,
+	)
+	statfsFilesDesc = prometheus.NewDesc(
+		"cephfs_statfs_files",
+		"Number of inodes in the filesystem, from statfs",
+		nil, nil,
+	)
+)
+
+// emitStatfs emits the capacity of the whole filesystem, which is a single
+// call independent of the walk
+func (c *Collector) emitStatfs(ch chan<- prometheus.Metric) {
+	if c.metricDisabled("cephfs_statfs_total_bytes") && c.metricDisabled("cephfs_statfs_free_bytes") && c.metricDisabled("cephfs_statfs_files") {
+		return
+	}
+
+	stat, err := c.filesystem.StatFS("/")
+	if err != nil {
+		// Skip quietly if not supported
+		var cephErr interface{ ErrorCode() int }
+		if errors.As(err, &cephErr) && (cephErr.ErrorCode() == -int(syscall.ENOSYS) || cephErr.ErrorCode() == -int(syscall.EOPNOTSUPP)) {
+			return
+		}
+		log.Printf("Getting statfs: %v", err)
+		return
+	}
+
+	if c.metricEnabled("cephfs_statfs_total_bytes") {
+		ch <- prometheus.MustNewConstMetric(
+			statfsTotalDesc,
+			prometheus.GaugeValue,
+			float64(stat.Blocks)*float64(stat.Frsize),
+		)
+	}
+	if c.metricEnabled("cephfs_statfs_free_bytes") {
+		ch <- prometheus.MustNewConstMetric(
+			statfsFreeDesc,
+			prometheus.GaugeValue,
+			float64(stat.Bfree)*float64(stat.Frsize),
+		)
+	}
+	if c.metricEnabled("cephfs_statfs_files") {
+		ch <- prometheus.MustNewConstMetric(
+			statfsFilesDesc,
+			prometheus.GaugeValue,
+			float64(stat.Files),
+		)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// observeSubtrees walks the subdirectories of a monitored path concurrently,
+// at most PER_SUBTREE_CONCURRENCY at a time, each with its own collection.
+// They are merged back in order, so the output is the same as walking them
+// one after the other
+func (c *walkConfig) observeSubtrees(dir *dirStats, subdirs []string, col *collection) error {
+	type result struct {
+		sub      *collection
+		observed bool
+		err      error
+		duration time.Duration
+	}
+	results := make([]result, len(subdirs))
+	slots := make(chan struct{}, c.subtreeWorkers)
+	var wg sync.WaitGroup
+	for i, subdir := range subdirs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, subdir string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := time.Now()
+			sub := col.fork()
+			observed, err := c.observePath(
+				subdir,
+				sub,
+				true, // optional, only observe if big enough
+				dir.level+1,
+			)
+			results[i] = result{sub, observed, err, time.Since(start)}
+		}(i, subdir)
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		if result.err != nil {
+			return result.err
+		}
+		col.merge(result.sub)
+		if result.observed {
+			dir.recursed = true
+			dir.childrenRecursed++
+			col.subtreeDurations[subdirs[i]] += result.duration
+		}
+	}
+	return nil
+}
+
+// fork returns the state to walk a subtree in another goroutine. Metrics are
+// only buffered, and the parent must not change until merge is called
+func (col *collection) fork() *collection {
+	sub := &collection{
+		filesystem:      col.filesystem,
+		emitted:         make(map[string]bool),
+		childrenEmitted: make(map[string]bool),
+		xattrs:          make(map[xattrKey]uint64),
+		previousRbytes:  col.previousRbytes,
+		previousEmitted: col.previousEmitted,
+		previousRctime:  col.previousRctime,
+		inCold:          col.inCold,
+		capture:         &pathCache{metrics: []prometheus.Metric{}},
+		root:            col.root,
+		parent:          col,
+
+		subtreeDurations: make(map[string]time.Duration),
+		pins:             make(map[string]int64),
+		series:           col.series,
+	}
+	if col.rbytes != nil {
+		sub.rbytes = make(map[string]uint64)
+	}
+	if col.rctime != nil {
+		sub.rctime = make(map[string]string)
+	}
+	if col.emittedRbytes != nil {
+		sub.emittedRbytes = make(map[string]uint64)
+	}
+	return sub
+}
+
+// merge adds the results of a subtree walked with fork
+func (col *collection) merge(sub *collection) {
+	for _, metric := range sub.capture.metrics {
+		col.emit(metric)
+	}
+	if col.capture != nil {
+		col.capture.dirs = append(col.capture.dirs, sub.capture.dirs...)
+		col.capture.topLevelPaths = append(col.capture.topLevelPaths, sub.capture.topLevelPaths...)
+	}
+	for path := range sub.emitted {
+		col.emitted[path] = true
+	}
+	for path := range sub.childrenEmitted {
+		col.childrenEmitted[path] = true
+	}
+	col.topLevelPaths = append(col.topLevelPaths, sub.topLevelPaths...)
+	for path, rbytes := range sub.rbytes {
+		col.rbytes[path] = rbytes
+	}
+	for path, rctime := range sub.rctime {
+		col.rctime[path] = rctime
+	}
+	for path, rbytes := range sub.emittedRbytes {
+		col.emittedRbytes[path] = rbytes
+	}
+
+	col.xattrReads += sub.xattrReads
+	col.xattrReadTime += sub.xattrReadTime
+	col.permissionDenied += sub.permissionDenied
+	if sub.largest != nil && (col.largest == nil || sub.largest.rbytes > col.largest.rbytes) {
+		col.largest = sub.largest
+	}
+	if sub.depth > col.depth {
+		col.depth = sub.depth
+	}
+	col.leafRbytes += sub.leafRbytes
+	col.coldBytes += sub.coldBytes
+}
+
+// wasEmitted returns whether a directory was already emitted, by this
+// collection or the one it was forked from
+func (col *collection) wasEmitted(path string) bool {
+	return col.emitted[path] || (col.parent != nil && col.parent.wasEmitted(path))
+}
+
+// childrenWereEmitted is wasEmitted for cephfs_children_recursed
+func (col *collection) childrenWereEmitted(path string) bool {
+	return col.childrenEmitted[path] || (col.parent != nil && col.parent.childrenWereEmitted(path))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ceph/go-ceph/cephfs"
+)
+
+// concurrencyFS counts how many calls to a filesystem run at the same time
+type concurrencyFS struct {
+	fsClient
+	active    int32
+	maxActive int32
+}
+
+func (fs *concurrencyFS) GetXattr(path string, name string) ([]byte, error) {
+	active := atomic.AddInt32(&fs.active, 1)
+	defer atomic.AddInt32(&fs.active, -1)
+	for {
+		max := atomic.LoadInt32(&fs.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&fs.maxActive, max, active) {
+			break
+		}
+	}
+	// Give the other workers time to start
+	time.Sleep(time.Millisecond)
+	return fs.fsClient.GetXattr(path, name)
+}
+
+func (fs *concurrencyFS) Statx(path string, want cephfs.StatxMask, flags cephfs.AtFlags) (*cephfs.CephStatx, error) {
+	return fs.fsClient.Statx(path, want, flags)
+}
+
+func TestSubtreeConcurrency(t *testing.T) {
+	tree := benchmarkTree(6, 2)
+	cfg := testWalkConfig()
+	cfg.countChildren = true
+	cfg.emitLocalBytes = true
+	serial := walkMetrics(t, newFakeFS(tree), "/", cfg)
+
+	cfg.subtreeWorkers = 3
+	fs := &concurrencyFS{fsClient: newFakeFS(tree)}
+	concurrent := walkMetrics(t, fs, "/", cfg)
+
+	// Same metrics in the same order
+	if !reflect.DeepEqual(serial, concurrent) {
+		sort.Strings(serial)
+		sort.Strings(concurrent)
+		t.Errorf("Concurrent walk differs:\n%v\n%v", serial, concurrent)
+	}
+
+	if fs.maxActive > 3 {
+		t.Errorf("Got %d concurrent reads, expected at most 3", fs.maxActive)
+	}
+	if fs.maxActive < 2 {
+		t.Errorf("Got %d concurrent reads, expected the subtrees to be walked concurrently", fs.maxActive)
+	}
+}
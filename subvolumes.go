@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ceph/go-ceph/cephfs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// subvolumesRoot is where the mgr volumes module (used by the CSI driver)
+// creates subvolumes, as <group>/<subvolume>
+const subvolumesRoot = "/volumes"
+
+// subvolumeInfoDesc carries the subvolume of a path, to join with. It can't be
+// a label of the directory metrics, which are also emitted for directories
+// outside of subvolumes
+var subvolumeInfoDesc = prometheus.NewDesc(
+	"cephfs_subvolume_info",
+	"Subvolume found at path, always 1",
+	[]string{"path", "group", "subvolume"}, nil,
+)
+
+var (
+	groupRbytesDesc = prometheus.NewDesc(
+		"cephfs_group_rbytes",
+		"Total size of the subvolumes of a subvolume group in bytes",
+		[]string{"group"}, nil,
+	)
+	groupRentriesDesc = prometheus.NewDesc(
+		"cephfs_group_rentries",
+		"Total number of files and subdirectories of the subvolumes of a subvolume group",
+		[]string{"group"}, nil,
+	)
+)
+
+type subvolume struct {
+	path  string
+	group string
+	name  string
+}
+
+// discoverSubvolumes lists the subvolumes of every group. For version 2
+// subvolumes (the ones with a .meta file), the data is in a single
+// subdirectory named by UUID, which is used as the path
+func (c *Collector) discoverSubvolumes(col *collection) ([]subvolume, error) {
+	groups, _, err := c.readDirNames(subvolumesRoot, col)
+	if err != nil && isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var subvolumes []subvolume
+	for _, group := range groups {
+		// Skip the internal directories (_deleting, _index, ...), but not
+		// the default group
+		if strings.HasPrefix(group, "_") && group != "_nogroup" {
+			continue
+		}
+		groupPath := filepath.Join(subvolumesRoot, group)
+		names, _, err := c.readDirNames(groupPath, col)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			path := filepath.Join(groupPath, name)
+			dirs, files, err := c.readDirNames(path, col)
+			if err != nil {
+				return nil, err
+			}
+			if len(dirs) == 1 && contains(files, ".meta") {
+				path = filepath.Join(path, dirs[0])
+			}
+			subvolumes = append(subvolumes, subvolume{path: path, group: group, name: name})
+		}
+	}
+	return subvolumes, nil
+}
+
+// observeGroups emits the totals of each subvolume group, from the recursive
+// stats of its directory, which add up all of its subvolumes
+func (c *Collector) observeGroups(col *collection) error {
+	groups, _, err := c.readDirNames(subvolumesRoot, col)
+	if err != nil && isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if strings.HasPrefix(group, "_") && group != "_nogroup" {
+			continue
+		}
+		groupPath := filepath.Join(subvolumesRoot, group)
+		if c.metricEnabled("cephfs_group_rbytes") {
+			rbytes, err := col.getNumXattr(col.filesystem, groupPath, "ceph.dir.rbytes")
+			if err != nil {
+				return fmt.Errorf("Failed to read rbytes of %s: %w", groupPath, err)
+			}
+			col.emit(prometheus.MustNewConstMetric(
+				groupRbytesDesc,
+				prometheus.GaugeValue,
+				float64(rbytes),
+				group,
+			))
+		}
+		if c.metricEnabled("cephfs_group_rentries") {
+			rentries, err := col.getNumXattr(col.filesystem, groupPath, "ceph.dir.rentries")
+			if err != nil {
+				return fmt.Errorf("Failed to read rentries of %s: %w", groupPath, err)
+			}
+			col.emit(prometheus.MustNewConstMetric(
+				groupRentriesDesc,
+				prometheus.GaugeValue,
+				float64(rentries),
+				group,
+			))
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the names of the subdirectories and other entries of a
+// directory
+func (c *Collector) readDirNames(path string, col *collection) ([]string, []string, error) {
+	handle, err := col.filesystem.OpenDir(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Opening directory %s: %w", path, err)
+	}
+	defer handle.Close()
+
+	var dirs, others []string
+	for {
+		entry, err := handle.ReadDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Reading directory %s: %w", path, err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Name() == "." || entry.Name() == ".." {
+			continue
+		}
+		if entry.DType() == cephfs.DTypeDir {
+			dirs = append(dirs, entry.Name())
+		} else {
+			others = append(others, entry.Name())
+		}
+	}
+	return dirs, others, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timestampXattr is an xattr holding a timestamp, from TIMESTAMP_XATTRS
+type timestampXattr struct {
+	name   string
+	metric string
+	desc   *prometheus.Desc
+}
+
+// timestampValue is the value of a timestampXattr for a directory
+type timestampValue struct {
+	xattr   *timestampXattr
+	seconds float64
+}
+
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// parseTimestampXattrs returns the metric to emit for each xattr, named after
+// it, e.g. cephfs_dir_rctime_seconds for ceph.dir.rctime
+func parseTimestampXattrs(names []string) ([]timestampXattr, error) {
+	xattrs := make([]timestampXattr, 0, len(names))
+	metrics := make(map[string]string)
+	for _, name := range names {
+		metric := strings.TrimPrefix(name, "ceph.")
+		metric = invalidMetricChars.ReplaceAllString(metric, "_")
+		metric = "cephfs_" + metric + "_seconds"
+		if other, ok := metrics[metric]; ok {
+			return nil, fmt.Errorf("%s and %s would both be emitted as %s", other, name, metric)
+		}
+		if contains(metricNames, metric) {
+			return nil, fmt.Errorf("%s would be emitted as %s, which already exists", name, metric)
+		}
+		metrics[metric] = name
+		xattrs = append(xattrs, timestampXattr{
+			name:   name,
+			metric: metric,
+			desc: prometheus.NewDesc(
+				metric,
+				fmt.Sprintf("Value of %s as a Unix timestamp", name),
+				[]string{"path"}, nil,
+			),
+		})
+	}
+	return xattrs, nil
+}
+
+// parseTimestamp parses a timestamp xattr such as ceph.dir.rctime, seconds
+// and nanoseconds (zero-padded to 9 digits) separated by a dot
+func parseTimestamp(value string) (time.Time, error) {
+	secondsStr, nanosStr, hasNanos := strings.Cut(value, ".")
+	seconds, err := strconv.ParseUint(secondsStr, 10, 63)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid seconds %q", secondsStr)
+	}
+	var nanos uint64
+	if hasNanos {
+		if nanosStr == "" || len(nanosStr) > 9 {
+			return time.Time{}, fmt.Errorf("Invalid nanoseconds %q", nanosStr)
+		}
+		nanos, err = strconv.ParseUint(nanosStr, 10, 32)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid nanoseconds %q", nanosStr)
+		}
+	}
+	return time.Unix(int64(seconds), int64(nanos)), nil
+}
+
+// readTimestamps reads the TIMESTAMP_XATTRS of a directory, reusing rctime if
+// it was already read. Directories without one of the xattrs, or with a
+// malformed value, just don't get that metric
+func (c *walkConfig) readTimestamps(path string, rctime string, col *collection) ([]timestampValue, error) {
+	var timestamps []timestampValue
+	for i := range c.timestampXattrs {
+		xattr := &c.timestampXattrs[i]
+		// Counted as suppressed here, since it's not read
+		if !c.metricEnabled(xattr.metric) {
+			continue
+		}
+		value := rctime
+		if xattr.name != "ceph.dir.rctime" || rctime == "" {
+			raw, err := getXattr(col.filesystem, path, xattr.name)
+			if err != nil && isNoAttribute(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("Getting %s: %w", xattr.name, err)
+			}
+			value = string(raw)
+		}
+
+		timestamp, err := parseTimestamp(value)
+		if err != nil {
+			log.Printf("%s: Invalid %s %q: %v", path, xattr.name, value, err)
+			continue
+		}
+		timestamps = append(timestamps, timestampValue{
+			xattr:   xattr,
+			seconds: float64(timestamp.UnixNano()) / 1e9,
+		})
+	}
+	return timestamps, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTimestampXattrsDisabled(t *testing.T) {
+	xattrs, err := parseTimestampXattrs([]string{"ceph.dir.rctime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testWalkConfig()
+	cfg.timestampXattrs = xattrs
+	metrics := walkMetrics(t, newFakeFS(testTree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_dir_rctime_seconds"), []string{"/", "/a", "/a/x", "/b"})
+
+	cfg.disabledMetrics = map[string]bool{"cephfs_dir_rctime_seconds": true}
+	metrics = walkMetrics(t, newFakeFS(testTree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_dir_rctime_seconds"), []string{})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate from TLS_CERT_FILE and TLS_KEY_FILE,
+// loading them again when they are modified, so certificates can be rotated
+// without restarting
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload loads the certificate if either file changed since it was last
+// loaded. The caller must hold the mutex, or be the constructor
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMtime) && keyInfo.ModTime().Equal(r.keyMtime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		log.Print("Loaded new TLS certificate")
+	}
+	r.cert = &cert
+	r.certMtime = certInfo.ModTime()
+	r.keyMtime = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate checks the files on each handshake, and keeps serving the
+// previous certificate if the new one can't be loaded, e.g. if the files are
+// being replaced
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.reload(); err != nil {
+		log.Printf("Failed to reload TLS certificate, using the previous one: %v", err)
+	}
+	return r.cert, nil
+}
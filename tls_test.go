@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key, with the given
+// common name and modification time
+func writeCert(t *testing.T, certFile string, keyFile string, name string, mtime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	}
+	if err == nil {
+		err = os.Chtimes(certFile, mtime, mtime)
+	}
+	if err == nil {
+		err = os.Chtimes(keyFile, mtime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName connects to the server and returns the common name of its
+// certificate
+func servedName(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Minute)
+	writeCert(t, certFile, keyFile, "first", start)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go server.Serve(tls.NewListener(listener, &tls.Config{GetCertificate: reloader.GetCertificate}))
+	defer server.Close()
+	addr := listener.Addr().String()
+
+	if name := servedName(t, addr); name != "first" {
+		t.Fatalf("Got certificate %q, expected first", name)
+	}
+
+	// Swapping the files is picked up on the next connection
+	writeCert(t, certFile, keyFile, "second", start.Add(time.Second))
+	if name := servedName(t, addr); name != "second" {
+		t.Fatalf("Got certificate %q after swapping, expected second", name)
+	}
+
+	// A half-written pair keeps the previous certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, start.Add(2*time.Second), start.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, addr); name != "second" {
+		t.Fatalf("Got certificate %q with an invalid key, expected second", name)
+	}
+}
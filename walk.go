@@ -0,0 +1,153 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/ceph/go-ceph/cephfs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fsClient is the part of the filesystem API used by the walk, so it can run
+// against something other than a CephFS mount
+type fsClient interface {
+	GetXattr(path string, name string) ([]byte, error)
+	Statx(path string, want cephfs.StatxMask, flags cephfs.AtFlags) (*cephfs.CephStatx, error)
+	OpenDir(path string) (dirReader, error)
+}
+
+// dirReader reads the entries of an open directory, one at a time. ReadDir
+// returns nil once all the entries have been read. ReadDirPlus also returns
+// their stat
+type dirReader interface {
+	ReadDir() (*dirEntry, error)
+	ReadDirPlus(want cephfs.StatxMask) (*dirEntry, error)
+	Close() error
+}
+
+type dirEntry struct {
+	name  string
+	dtype cephfs.DType
+	stat  *cephfs.CephStatx
+}
+
+func (e *dirEntry) Name() string {
+	return e.name
+}
+
+func (e *dirEntry) DType() cephfs.DType {
+	return e.dtype
+}
+
+// cephClient is the fsClient for a CephFS mount
+type cephClient struct {
+	*cephfs.MountInfo
+}
+
+func (fs cephClient) OpenDir(path string) (dirReader, error) {
+	handle, err := fs.MountInfo.OpenDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return cephDir{handle}, nil
+}
+
+type cephDir struct {
+	*cephfs.Directory
+}
+
+func (dir cephDir) ReadDir() (*dirEntry, error) {
+	entry, err := dir.Directory.ReadDir()
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	dirEntriesRead.Inc()
+	return &dirEntry{name: entry.Name(), dtype: entry.DType()}, nil
+}
+
+func (dir cephDir) ReadDirPlus(want cephfs.StatxMask) (*dirEntry, error) {
+	entry, err := dir.Directory.ReadDirPlus(want, cephfs.AtSymlinkNofollow)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	dirEntriesRead.Inc()
+	return &dirEntry{name: entry.Name(), dtype: entry.DType(), stat: entry.Statx()}, nil
+}
+
+// walkConfig holds the options that control the walk of a path
+type walkConfig struct {
+	recurseMinSize   uint64
+	recurseMaxLevels int
+	recurseStrategy  string
+	leavesOnly       bool
+	countChildren    bool
+	skipEmptyDirs    bool
+	skipRootPath     bool
+	emitMinEntries   uint64
+	excludeName      *regexp.Regexp
+	maxEntriesPerDir int
+	maxSeries        int
+	filterUID        int64
+	filterGID        int64
+	filterPrune      bool
+	emitObjects      bool
+	recurseByRank    bool
+	subtreeWorkers   int
+	trackLargeFiles  bool
+	largeFileMinSize uint64
+	readDirPlus      bool
+	minChangePercent float64
+	modifiedSince    time.Duration
+	coldDataAge      time.Duration
+	emitLocalBytes   bool
+	emitLayout       bool
+	emitStatx        bool
+	emitQuota        bool
+	timestampXattrs  []timestampXattr
+	markTruncated    bool
+	relpathLabel     bool
+	pathComponents   bool
+	hashPathLabels   bool
+	hashKeepLevels   int
+	pathLabelStyle   string
+	disabledMetrics  map[string]bool
+	rbytesDesc       *prometheus.Desc
+	rentriesDesc     *prometheus.Desc
+	dirInfoDesc      *prometheus.Desc
+}
+
+// newCollection returns the state for a new walk, sending the metrics to
+// emit if not nil
+func newCollection(fs fsClient, emit func(prometheus.Metric)) *collection {
+	return &collection{
+		filesystem: fs,
+		send:       emit,
+		emitted:    make(map[string]bool),
+		xattrs:     make(map[xattrKey]uint64),
+
+		subtreeDurations: make(map[string]time.Duration),
+		childrenEmitted:  make(map[string]bool),
+		pins:             make(map[string]int64),
+		series:           new(int64),
+	}
+}
+
+// walk emits the metrics for start and its subdirectories. It only needs a
+// filesystem, so it can be benchmarked or tested without a Collector
+func walk(fs fsClient, start string, cfg *walkConfig, emit func(prometheus.Metric)) error {
+	return cfg.walkPath(start, newCollection(fs, emit))
+}
+
+// walkPath walks a single monitored path with the configured strategy
+func (c *walkConfig) walkPath(path string, col *collection) error {
+	col.root = path
+	col.depth = 0
+	col.coldBytes = 0
+	col.rootRbytes, col.leafRbytes = 0, 0
+	col.rootRecursed = false
+	if c.recurseStrategy == "bfs" {
+		return c.observePathBFS(path, col)
+	}
+	_, err := c.observePath(path, col, false, 0)
+	return err
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ceph/go-ceph/cephfs"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeErr is a Ceph error code, like the errors returned by go-ceph
+type fakeErr int
+
+func (e fakeErr) Error() string {
+	return fmt.Sprintf("errno %d", -int(e))
+}
+
+func (e fakeErr) ErrorCode() int {
+	return int(e)
+}
+
+var (
+	errNotFound = fakeErr(-int(syscall.ENOENT))
+	errNoData   = fakeErr(-int(syscall.ENODATA))
+	errDenied   = fakeErr(-int(syscall.EACCES))
+)
+
+// fakeFS is an in-memory tree of directories, to walk without a cluster
+type fakeFS struct {
+	mutex sync.Mutex
+	dirs  map[string]*fakeDir
+	// files are the regular files added with addFile, and their size
+	files map[string]uint64
+	// denied are the directories that can't be read, as with restricted caps
+	denied map[string]bool
+	// xattrReads is the number of xattrs read, and stats of statx calls
+	xattrReads int
+	stats      int
+	// latency is how long reading an xattr takes. Reads are serialized, like
+	// on a single mount
+	latency time.Duration
+}
+
+type fakeDir struct {
+	rbytes   uint64
+	children []string
+}
+
+// newFakeFS creates a tree from the size of each directory, creating the
+// missing parents with size 0
+func newFakeFS(sizes map[string]uint64) *fakeFS {
+	fs := &fakeFS{
+		dirs:   map[string]*fakeDir{"/": {}},
+		files:  make(map[string]uint64),
+		denied: make(map[string]bool),
+	}
+	paths := make([]string, 0, len(sizes))
+	for path := range sizes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fs.addDir(path).rbytes = sizes[path]
+	}
+	return fs
+}
+
+func (fs *fakeFS) addDir(path string) *fakeDir {
+	if dir, ok := fs.dirs[path]; ok {
+		return dir
+	}
+	parent := fs.addDir(filepath.Dir(path))
+	parent.children = append(parent.children, filepath.Base(path))
+	dir := &fakeDir{}
+	fs.dirs[path] = dir
+	return dir
+}
+
+func (fs *fakeFS) addFile(path string, size uint64) {
+	parent := fs.addDir(filepath.Dir(path))
+	parent.children = append(parent.children, filepath.Base(path))
+	fs.files[path] = size
+}
+
+func (fs *fakeFS) lookup(path string) (*fakeDir, error) {
+	if fs.denied[path] {
+		return nil, errDenied
+	}
+	dir, ok := fs.dirs[path]
+	if !ok {
+		return nil, errNotFound
+	}
+	return dir, nil
+}
+
+func (fs *fakeFS) GetXattr(path string, name string) ([]byte, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.xattrReads++
+	if fs.latency > 0 {
+		time.Sleep(fs.latency)
+	}
+	dir, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "ceph.dir.rbytes":
+		return []byte(strconv.FormatUint(dir.rbytes, 10)), nil
+	case "ceph.dir.rentries":
+		// Say there is one entry per 100 bytes
+		return []byte(strconv.FormatUint(dir.rbytes/100, 10)), nil
+	case "ceph.dir.rctime":
+		return []byte("1700000000.000000000"), nil
+	}
+	return nil, errNoData
+}
+
+func (fs *fakeFS) Statx(path string, want cephfs.StatxMask, flags cephfs.AtFlags) (*cephfs.CephStatx, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.stats++
+	if size, ok := fs.files[path]; ok {
+		return &cephfs.CephStatx{Size: size, Nlink: 1}, nil
+	}
+	if _, err := fs.lookup(path); err != nil {
+		return nil, err
+	}
+	return &cephfs.CephStatx{Nlink: 2}, nil
+}
+
+func (fs *fakeFS) OpenDir(path string) (dirReader, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	dir, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []dirEntry{
+		{name: ".", dtype: cephfs.DTypeDir},
+		{name: "..", dtype: cephfs.DTypeDir},
+	}
+	for _, name := range dir.children {
+		entry := dirEntry{name: name, dtype: cephfs.DTypeDir}
+		if size, ok := fs.files[filepath.Join(path, name)]; ok {
+			entry.dtype = cephfs.DTypeReg
+			entry.stat = &cephfs.CephStatx{Size: size, Nlink: 1}
+		}
+		entries = append(entries, entry)
+	}
+	return &fakeDirReader{entries: entries}, nil
+}
+
+type fakeDirReader struct {
+	entries []dirEntry
+}
+
+func (r *fakeDirReader) ReadDir() (*dirEntry, error) {
+	entry, err := r.ReadDirPlus(0)
+	if entry != nil {
+		entry.stat = nil
+	}
+	return entry, err
+}
+
+func (r *fakeDirReader) ReadDirPlus(want cephfs.StatxMask) (*dirEntry, error) {
+	if len(r.entries) == 0 {
+		return nil, nil
+	}
+	entry := r.entries[0]
+	r.entries = r.entries[1:]
+	return &entry, nil
+}
+
+func (r *fakeDirReader) Close() error {
+	return nil
+}
+
+// testWalkConfig returns the default settings, recursing into directories of
+// 1000 bytes or more
+func testWalkConfig() *walkConfig {
+	cfg := &walkConfig{
+		recurseMinSize:   1000,
+		recurseMaxLevels: 5,
+		recurseStrategy:  "dfs",
+		filterUID:        -1,
+		filterGID:        -1,
+		subtreeWorkers:   1,
+	}
+	cfg.rbytesDesc, cfg.rentriesDesc = dirDescs(false, false, false)
+	return cfg
+}
+
+// testCollector returns a Collector walking the given mounts, with the
+// settings of testWalkConfig and no statfs metrics
+func testCollector(mounts ...fsClient) *Collector {
+	c := &Collector{
+		walkConfig: *testWalkConfig(),
+		mounts:     make(chan fsClient, len(mounts)),
+		paths:      []string{"/"},
+		pathCaches: make(map[string]*pathCache),
+	}
+	for _, mount := range mounts {
+		c.mounts <- mount
+	}
+	// statfs is read from the main mount, which there is none of
+	c.disabledMetrics = map[string]bool{
+		"cephfs_statfs_total_bytes": true,
+		"cephfs_statfs_free_bytes":  true,
+		"cephfs_statfs_files":       true,
+	}
+	return c
+}
+
+var (
+	descName  = regexp.MustCompile(`fqName: "([^"]*)"`)
+	pathValue = regexp.MustCompile(`path="([^"]*)"`)
+)
+
+// formatMetric formats a metric as name{label="value",...} value
+func formatMetric(metric prometheus.Metric) string {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return fmt.Sprintf("invalid metric: %v", err)
+	}
+	labels := make([]string, 0, len(m.Label))
+	for _, label := range m.Label {
+		labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+	var value float64
+	if m.Gauge != nil {
+		value = m.Gauge.GetValue()
+	} else if m.Counter != nil {
+		value = m.Counter.GetValue()
+	}
+	name := descName.FindStringSubmatch(metric.Desc().String())[1]
+	return fmt.Sprintf("%s{%s} %g", name, strings.Join(labels, ","), value)
+}
+
+// walkMetrics walks a tree and returns the metrics emitted, in order
+func walkMetrics(t testing.TB, fs fsClient, start string, cfg *walkConfig) []string {
+	t.Helper()
+	var metrics []string
+	err := walk(fs, start, cfg, func(metric prometheus.Metric) {
+		metrics = append(metrics, formatMetric(metric))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+// emittedPaths returns the paths that a metric was emitted for, in order
+func emittedPaths(metrics []string, name string) []string {
+	paths := []string{}
+	for _, metric := range metrics {
+		if !strings.HasPrefix(metric, name+"{") {
+			continue
+		}
+		if match := pathValue.FindStringSubmatch(metric); match != nil {
+			paths = append(paths, match[1])
+		}
+	}
+	return paths
+}
+
+func checkPaths(t *testing.T, got []string, expected []string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got paths %v, expected %v", got, expected)
+	}
+}
+
+// testTree has /a/y and /c below the recursion size
+var testTree = map[string]uint64{
+	"/":    10000,
+	"/a":   5000,
+	"/a/x": 3000,
+	"/a/y": 500,
+	"/b":   4000,
+	"/c":   200,
+	"/c/z": 100,
+}
+
+func TestLeavesOnly(t *testing.T) {
+	cfg := testWalkConfig()
+	metrics := walkMetrics(t, newFakeFS(testTree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/a", "/a/x", "/b"})
+
+	// Intermediate directories are not emitted, /a/x and /b are the deepest
+	// directories reached
+	cfg.leavesOnly = true
+	metrics = walkMetrics(t, newFakeFS(testTree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/a/x", "/b"})
+	checkPaths(t, emittedPaths(metrics, "cephfs_rentries"), []string{"/a/x", "/b"})
+
+	// Directories stopped by the level gate are leaves too
+	cfg.recurseMaxLevels = 1
+	metrics = walkMetrics(t, newFakeFS(testTree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/a", "/b"})
+}
+
+func TestRecurseStrategyOrder(t *testing.T) {
+	tree := map[string]uint64{
+		"/":           10000,
+		"/a":          6000,
+		"/a/x":        5000,
+		"/a/x/deep":   4000,
+		"/b":          3000,
+		"/b/y":        2000,
+		"/b/y/deeper": 100,
+	}
+
+	cfg := testWalkConfig()
+	metrics := walkMetrics(t, newFakeFS(tree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/a", "/a/x", "/a/x/deep", "/b", "/b/y"})
+
+	// Level by level, with the same result
+	cfg.recurseStrategy = "bfs"
+	metrics = walkMetrics(t, newFakeFS(tree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/a", "/b", "/a/x", "/b/y", "/a/x/deep"})
+}
+
+// benchmarkTree returns a tree where every directory is big enough to be
+// recursed into, with width subdirectories per directory
+func benchmarkTree(width int, depth int) map[string]uint64 {
+	sizes := map[string]uint64{}
+	var add func(path string, level int) uint64
+	add = func(path string, level int) uint64 {
+		size := uint64(1000)
+		if level < depth {
+			for i := 0; i < width; i++ {
+				size += add(filepath.Join(path, fmt.Sprintf("d%d", i)), level+1)
+			}
+		}
+		sizes[path] = size
+		return size
+	}
+	add("/", 0)
+	return sizes
+}
+
+// BenchmarkWalkXattrs compares reading every xattr when it is needed to
+// reusing the values already read during the walk, with EMIT_LOCAL_BYTES
+// reading the size of each subdirectory twice
+func BenchmarkWalkXattrs(b *testing.B) {
+	fs := newFakeFS(benchmarkTree(4, 4))
+	cfg := testWalkConfig()
+	cfg.emitLocalBytes = true
+
+	b.Run("reuse", func(b *testing.B) {
+		fs.xattrReads = 0
+		for i := 0; i < b.N; i++ {
+			if err := walk(fs, "/", cfg, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(fs.xattrReads)/float64(b.N), "xattrs/op")
+	})
+	b.Run("per-metric", func(b *testing.B) {
+		fs.xattrReads = 0
+		for i := 0; i < b.N; i++ {
+			col := newCollection(fs, nil)
+			col.xattrs = nil
+			if err := cfg.walkPath("/", col); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(fs.xattrReads)/float64(b.N), "xattrs/op")
+	})
+}
+
+func TestPermissionDenied(t *testing.T) {
+	fs := newFakeFS(testTree)
+	fs.denied["/a"] = true
+
+	// The subtree is skipped, and the rest of the tree is still walked
+	var metrics []string
+	col := newCollection(fs, func(metric prometheus.Metric) {
+		metrics = append(metrics, formatMetric(metric))
+	})
+	if err := testWalkConfig().walkPath("/", col); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/b"})
+	if col.permissionDenied != 1 {
+		t.Errorf("Got %d directories denied, expected 1", col.permissionDenied)
+	}
+}
+
+// BenchmarkListLargeDir lists a flat directory of files with
+// TRACK_LARGE_FILES, getting their size with a statx call per file or with
+// READDIR_PLUS. The fake statx is only a lookup, on a cluster it is a call
+// into libcephfs that might need the MDS
+func BenchmarkListLargeDir(b *testing.B) {
+	for _, entries := range []int{1000, 10000, 100000} {
+		fs := newFakeFS(map[string]uint64{"/": uint64(entries) * 1000})
+		for i := 0; i < entries; i++ {
+			fs.addFile(fmt.Sprintf("/f%d", i), 1000)
+		}
+		for _, readDirPlus := range []bool{false, true} {
+			name := fmt.Sprintf("%d/readdir", entries)
+			if readDirPlus {
+				name = fmt.Sprintf("%d/readdirplus", entries)
+			}
+			b.Run(name, func(b *testing.B) {
+				cfg := testWalkConfig()
+				cfg.trackLargeFiles = true
+				cfg.largeFileMinSize = 1000
+				cfg.readDirPlus = readDirPlus
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					if err := walk(fs, "/", cfg, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*entries), "ns/entry")
+			})
+		}
+	}
+}
+
+func TestReadDirPlus(t *testing.T) {
+	fs := newFakeFS(map[string]uint64{"/": 10000, "/a": 5000})
+	fs.addFile("/big", 4000)
+	fs.addFile("/small", 10)
+	cfg := testWalkConfig()
+	cfg.trackLargeFiles = true
+	cfg.largeFileMinSize = 1000
+
+	// Same metrics, without a statx per file
+	metrics := walkMetrics(t, fs, "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_file_size_bytes"), []string{"/big"})
+	if fs.stats != 2 {
+		t.Errorf("Got %d statx calls, expected 2", fs.stats)
+	}
+	cfg.readDirPlus = true
+	fs.stats = 0
+	metrics = walkMetrics(t, fs, "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_file_size_bytes"), []string{"/big"})
+	if fs.stats != 0 {
+		t.Errorf("Got %d statx calls with READDIR_PLUS, expected 0", fs.stats)
+	}
+}
+
+func TestSkipEmptyDirs(t *testing.T) {
+	tree := map[string]uint64{
+		"/":        1000,
+		"/a":       1000,
+		"/a/empty": 0,
+		"/empty":   0,
+	}
+
+	cfg := testWalkConfig()
+	cfg.recurseMinSize = 0
+	metrics := walkMetrics(t, newFakeFS(tree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/a", "/a/empty", "/empty"})
+
+	cfg.skipEmptyDirs = true
+	metrics = walkMetrics(t, newFakeFS(tree), "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/", "/a"})
+
+	// The monitored path is emitted even if it is empty
+	metrics = walkMetrics(t, newFakeFS(tree), "/empty", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_rbytes"), []string{"/empty"})
+}
+
+func TestLocalBytesMaxEntries(t *testing.T) {
+	cfg := testWalkConfig()
+	cfg.recurseMaxLevels = 0
+	cfg.emitLocalBytes = true
+	fs := newFakeFS(testTree)
+	walkMetrics(t, fs, "/", cfg)
+	// rbytes and rentries of /, then rbytes of /a, /b and /c
+	if fs.xattrReads != 5 {
+		t.Errorf("Got %d xattr reads, expected 5", fs.xattrReads)
+	}
+
+	// Only /a is listed, the rest counts as local
+	cfg.maxEntriesPerDir = 1
+	fs = newFakeFS(testTree)
+	metrics := walkMetrics(t, fs, "/", cfg)
+	if fs.xattrReads != 3 {
+		t.Errorf("Got %d xattr reads, expected 3", fs.xattrReads)
+	}
+	expected := `cephfs_local_bytes{path="/"} 5000`
+	found := false
+	for _, metric := range metrics {
+		found = found || metric == expected
+	}
+	if !found {
+		t.Errorf("Missing %s in %v", expected, metrics)
+	}
+}
+
+// vanishingFS is a tree where a file is deleted after it is listed
+type vanishingFS struct {
+	*fakeFS
+	deleted string
+}
+
+func (fs vanishingFS) Statx(path string, want cephfs.StatxMask, flags cephfs.AtFlags) (*cephfs.CephStatx, error) {
+	if path == fs.deleted {
+		return nil, errNotFound
+	}
+	return fs.fakeFS.Statx(path, want, flags)
+}
+
+func TestLargeFileDeleted(t *testing.T) {
+	fs := newFakeFS(map[string]uint64{"/": 10000})
+	fs.addFile("/big", 4000)
+	fs.addFile("/gone", 4000)
+	cfg := testWalkConfig()
+	cfg.trackLargeFiles = true
+	cfg.largeFileMinSize = 1000
+
+	// The walk goes on without it
+	metrics := walkMetrics(t, vanishingFS{fs, "/gone"}, "/", cfg)
+	checkPaths(t, emittedPaths(metrics, "cephfs_file_size_bytes"), []string{"/big"})
+}